@@ -1,233 +1,5433 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"expvar"
 	"fmt"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/idna"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/time/rate"
-	"io/ioutil"
+	"io"
+	"math"
+	"mime"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const PORT = ":8090"
+const VERSION = "0.2.0"
 const UrlLimit = 20
+const UrlTimeout = time.Second
+const MinTimeout = 100 * time.Millisecond
+const HostLimit = 10
 const LimitOutgoingConnections = 3
+const CheckLimit = 100
+const CheckQueueTimeout = 5 * time.Second
 const HttpLimitPerSecons = 100
 const HttpLimitPerSeconsBoost = 140
+const IpLimitPerSecond = 25
+const IpLimitPerSecondBoost = 35
+const IpLimitIdle = time.Minute
+const BodyLimit = 10 << 20
+const UploadLimit = 1 << 20
+const SourcePageLimit = 10
+const SchemaErrorLimit = 20
+const DrainLimit = 64 << 10
+const ResultLimit = 16 << 10
+const DialLimitPerFamily = 50
+const DNSTimeout = 500 * time.Millisecond
+const DNSCacheSize = 1000
+const PortStatsSize = 1000
+const ETagCacheSize = 1000
+const FdBackoff = 250 * time.Millisecond
+const DialRetryDelay = 50 * time.Millisecond
+const TCPKeepAlive = 30 * time.Second
+const SampleLimit = 10
+const RetryLimit = 3
+const HSTSMinAge = 180 * 24 * 60 * 60
+const SlowTLSHandshake = 300 * time.Millisecond
+const ExpectContinueWait = 250 * time.Millisecond
+const RetryBackoff = 100 * time.Millisecond
+const RetryBackoffMax = time.Second
+const AlertDedup = 5 * time.Minute
+const WriteTimeout = time.Minute
+const AlertsPerMinute = 6
+const ScheduleInterval = time.Minute
+const HealthWindow = 5 * time.Minute
+const HealthMinSuccess = 0.5
+const HealthMinChecks = 10
+const MaintenanceRetryAfter = 5 * time.Minute
+
+//Server configuration, defaults can be overridden from environment
+type Config struct {
+	//Distinct hosts allowed in one request, so it can't be used to scan, 0 is unlimited
+	HostLimit int
+	//Url checks running at once over all batches, 0 is unlimited. Batches wait
+	//up to QueueTimeout for a free slot, then fail with 503
+	CheckLimit   int
+	QueueTimeout time.Duration
+	//Per client ip limit, 0 disables it
+	IpLimitPerSecond float64
+	IpLimitBoost     int
+	//Idle client ip limiters are evicted after this period
+	IpLimitIdle time.Duration
+	//When set, /check requires one of these (or a trusted key) in X-Api-Key
+	ApiKeys []string
+	//Callers sending one of these in X-Api-Key are not rate limited (internal services)
+	TrustedKeys []string
+	//X-Api-Key values for /admin endpoints, they are off without any
+	AdminKeys []string
+	//Start in maintenance mode, /check answers 503 until it's switched off (a reload changing it switches too)
+	Maintenance bool
+	//Proxies allowed to set X-Forwarded-For (ips or cidrs)
+	TrustedProxies []*net.IPNet
+	//Max bytes read from a checked url body
+	BodyLimit int64
+	//Serialized size of one url result, trailers and annotations are dropped past it, 0 is unlimited
+	ResultLimit int
+	//Unread body bytes drained before close so the connection can be reused,
+	//0 closes right away (the connection is dropped)
+	DrainLimit int64
+	//Aggregate bytes/sec read from all checked bodies, 0 is unlimited
+	BandwidthLimit int
+	//Host resolution gets its own timeout inside the url timeout
+	DNSTimeout time.Duration
+	//Resolved hosts are reused for this long (fixed ttl), 0 disables the cache
+	DNSCacheTTL time.Duration
+	//Concurrent outgoing connection attempts per ip family, 0 is unlimited
+	DialLimitV4 int
+	DialLimitV6 int
+	//Open outgoing connections per host:port, extra requests wait for one, 0 is unlimited
+	PortConnLimit int
+	//Keep-alive probe period of outgoing connections (net/http default), negative disables it
+	TCPKeepAlive time.Duration
+	//Failed connects are redialed this many times, independent of request Retries
+	DialRetries int
+	//New dials wait this long after running out of file descriptors, 0 disables it
+	FdBackoff time.Duration
+	//Named proxies urls can be checked through (Regions option), name=proxy url
+	RegionProxies map[string]*url.URL
+	//Failed batches are posted to this Slack/Discord webhook, empty disables alerts
+	AlertWebhook string
+	//slack or discord
+	AlertFormat string
+	//Same failure is not alerted again within this period
+	AlertDedup time.Duration
+	//Server write timeout, batches end (with partial results) before it cuts the connection
+	WriteTimeout time.Duration
+	//Url timeouts (TimeoutMs, TimeBudget shares) are raised to this, shorter ones just look like outages
+	MinTimeout time.Duration
+	//Urls taken from a UrlsSource (all its pages together), UrlLimit still applies
+	SourceLimit int
+	//UrlsSource may be on loopback and private networks (otherwise refused at connect)
+	SourcePrivate bool
+	//Identical requests with If-None-Match of their last ETag get 304 within this, 0 disables ETags
+	ETagTTL time.Duration
+	//S3-compatible bucket batches are archived to (Archive option), path style urls
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	//Urls re-checked in background, latest results are served at /status
+	ScheduleUrls     []string
+	ScheduleInterval time.Duration
+	//Hosts (as urls) connected to at startup, the first checks find keep-alive connections
+	WarmUrls []string
+	//Deep /healthz degrades when the success rate of url checks in the window drops below this
+	HealthWindow     time.Duration
+	HealthMinSuccess float64
+	//Wait between readiness 503 and shutdown
+	DrainPeriod time.Duration
+	//Enables debug endpoints (/benchmark)
+	Debug bool
+}
+
+/**
+	Live config, POST /admin/reload swaps it whole. Batches keep the one they started
+	with (CheckOptions.settings, configFrom for their dials).
+ */
+var liveConfig = newLiveConfig(loadConfig(nil))
+
+func newLiveConfig(c Config) *atomic.Pointer[Config] {
+	live := &atomic.Pointer[Config]{}
+	live.Store(&c)
+	return live
+}
+
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+type configKey struct{}
+
+func withConfig(ctx context.Context, config *Config) context.Context {
+	return context.WithValue(ctx, configKey{}, config)
+}
+
+func configFrom(ctx context.Context) *Config {
+	if config, ok := ctx.Value(configKey{}).(*Config); ok {
+		return config
+	}
+	return currentConfig()
+}
+
+//Env names set to values the last loadConfig couldn't parse (defaults were used)
+var envProblems []string
+
+func (env configEnv) badEnv(name string) {
+	if env.get(name) != "" {
+		envProblems = append(envProblems, name)
+	}
+}
+
+//Values that parse but can't work, a reload refuses them
+func (c Config) validate() error {
+	switch {
+		case c.BodyLimit <= 0:
+			return fmt.Errorf("BODY_LIMIT must be positive")
+		case c.MinTimeout <= 0:
+			return fmt.Errorf("MIN_TIMEOUT must be positive")
+		case c.HostLimit < 0 || c.SourceLimit < 0 || c.ResultLimit < 0 || c.DrainLimit < 0 || c.DialRetries < 0 ||
+			c.IpLimitPerSecond < 0 || c.IpLimitBoost < 0:
+			return fmt.Errorf("negative limit")
+		case c.QueueTimeout < 0 || c.IpLimitIdle < 0 || c.DNSTimeout < 0 || c.FdBackoff < 0 || c.AlertDedup < 0 ||
+			c.ETagTTL < 0 || c.DrainPeriod < 0:
+			return fmt.Errorf("negative duration")
+		case c.HealthMinSuccess < 0 || c.HealthMinSuccess > 1:
+			return fmt.Errorf("HEALTH_MIN_SUCCESS must be between 0 and 1")
+		case c.AlertFormat != "slack" && c.AlertFormat != "discord":
+			return fmt.Errorf("ALERT_FORMAT must be slack or discord")
+	}
+	return nil
+}
+
+//Used once at start (server, transports, dial limits, slots, schedule), by field name
+var startupFields = map[string]string{
+	"CheckLimit":       "CHECK_LIMIT",
+	"BandwidthLimit":   "BANDWIDTH_LIMIT",
+	"DNSCacheTTL":      "DNS_CACHE_TTL",
+	"DialLimitV4":      "DIAL_LIMIT_V4",
+	"DialLimitV6":      "DIAL_LIMIT_V6",
+	"PortConnLimit":    "PORT_CONN_LIMIT",
+	"TCPKeepAlive":     "TCP_KEEPALIVE",
+	"RegionProxies":    "REGION_PROXIES",
+	"WriteTimeout":     "WRITE_TIMEOUT",
+	"ScheduleUrls":     "SCHEDULE_URLS",
+	"ScheduleInterval": "SCHEDULE_INTERVAL",
+	"WarmUrls":         "WARM_URLS",
+	"HealthWindow":     "HEALTH_WINDOW",
+	"Debug":            "DEBUG",
+}
+
+//Startup fields keep the running values, the env names of changed ones are returned
+func (c *Config) keepStartup(running *Config) []string {
+	fresh, old := reflect.ValueOf(c).Elem(), reflect.ValueOf(running).Elem()
+	var restart []string
+	for field, env := range startupFields {
+		if !reflect.DeepEqual(fresh.FieldByName(field).Interface(), old.FieldByName(field).Interface()) {
+			restart = append(restart, env)
+			fresh.FieldByName(field).Set(old.FieldByName(field))
+		}
+	}
+	sort.Strings(restart)
+	return restart
+}
+
+func loadConfig(overrides map[string]string) Config {
+	envProblems = nil
+	return configEnv{overrides: overrides}.config()
+}
+
+//Env names loadConfig reads, the only keys a reload takes
+func configNames() map[string]bool {
+	env := configEnv{read: map[string]bool{}}
+	env.config()
+	return env.read
+}
+
+func (env configEnv) config() Config {
+	return Config{
+		HostLimit:        env.envInt("HOST_LIMIT", HostLimit),
+		CheckLimit:       env.envInt("CHECK_LIMIT", CheckLimit),
+		QueueTimeout:     env.envDuration("QUEUE_TIMEOUT", CheckQueueTimeout),
+		IpLimitPerSecond: env.envFloat("IP_LIMIT_PER_SECOND", IpLimitPerSecond),
+		IpLimitBoost:     env.envInt("IP_LIMIT_BOOST", IpLimitPerSecondBoost),
+		IpLimitIdle:      env.envDuration("IP_LIMIT_IDLE", IpLimitIdle),
+		ApiKeys:          env.envList("API_KEYS"),
+		TrustedKeys:      env.envList("TRUSTED_KEYS"),
+		AdminKeys:        env.envList("ADMIN_KEYS"),
+		Maintenance:      env.envBool("MAINTENANCE", false),
+		TrustedProxies:   env.envNets("TRUSTED_PROXIES"),
+		BodyLimit:        int64(env.envInt("BODY_LIMIT", BodyLimit)),
+		DrainLimit:       int64(env.envInt("DRAIN_LIMIT", DrainLimit)),
+		ResultLimit:      env.envInt("RESULT_LIMIT", ResultLimit),
+		BandwidthLimit:   env.envInt("BANDWIDTH_LIMIT", 0),
+		DNSTimeout:       env.envDuration("DNS_TIMEOUT", DNSTimeout),
+		DNSCacheTTL:      env.envDuration("DNS_CACHE_TTL", 0),
+		DialLimitV4:      env.envInt("DIAL_LIMIT_V4", DialLimitPerFamily),
+		DialLimitV6:      env.envInt("DIAL_LIMIT_V6", DialLimitPerFamily),
+		PortConnLimit:    env.envInt("PORT_CONN_LIMIT", 0),
+		TCPKeepAlive:     env.envDuration("TCP_KEEPALIVE", TCPKeepAlive),
+		DialRetries:      env.envInt("DIAL_RETRIES", 0),
+		FdBackoff:        env.envDuration("FD_BACKOFF", FdBackoff),
+		RegionProxies:    env.envProxies("REGION_PROXIES"),
+		AlertWebhook:     env.get("ALERT_WEBHOOK"),
+		AlertFormat:      env.envString("ALERT_FORMAT", "slack"),
+		AlertDedup:       env.envDuration("ALERT_DEDUP", AlertDedup),
+		WriteTimeout:     env.envDuration("WRITE_TIMEOUT", WriteTimeout),
+		MinTimeout:       env.envDuration("MIN_TIMEOUT", MinTimeout),
+		ETagTTL:          env.envDuration("ETAG_TTL", 0),
+		SourceLimit:      env.envInt("SOURCE_LIMIT", UrlLimit),
+		SourcePrivate:    env.envBool("SOURCE_ALLOW_PRIVATE", false),
+		S3Endpoint:       env.get("S3_ENDPOINT"),
+		S3Bucket:         env.get("S3_BUCKET"),
+		S3Region:         env.envString("S3_REGION", "us-east-1"),
+		S3AccessKey:      env.get("S3_ACCESS_KEY"),
+		S3SecretKey:      env.get("S3_SECRET_KEY"),
+		ScheduleUrls:     env.envList("SCHEDULE_URLS"),
+		ScheduleInterval: env.envDuration("SCHEDULE_INTERVAL", ScheduleInterval),
+		WarmUrls:         env.envList("WARM_URLS"),
+		HealthWindow:     env.envDuration("HEALTH_WINDOW", HealthWindow),
+		HealthMinSuccess: env.envFloat("HEALTH_MIN_SUCCESS", HealthMinSuccess),
+		DrainPeriod:      env.envDuration("DRAIN_PERIOD", 0),
+		Debug:            env.envBool("DEBUG", false),
+	}
+}
+
+/**
+	Where loadConfig takes values from: overrides (a reload body) first, then the
+	process environment. With read set it records the names asked for.
+ */
+type configEnv struct {
+	overrides map[string]string
+	read      map[string]bool
+}
+
+func (env configEnv) get(name string) string {
+	if env.read != nil {
+		env.read[name] = true
+	}
+	if v, ok := env.overrides[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+
+func (env configEnv) envFloat(name string, def float64) float64 {
+	if v, err := strconv.ParseFloat(env.get(name), 64); err == nil {
+		return v
+	}
+	env.badEnv(name)
+	return def
+}
+
+func (env configEnv) envString(name string, def string) string {
+	if v := env.get(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func (env configEnv) envBool(name string, def bool) bool {
+	if v, err := strconv.ParseBool(env.get(name)); err == nil {
+		return v
+	}
+	env.badEnv(name)
+	return def
+}
+
+func (env configEnv) envInt(name string, def int) int {
+	if v, err := strconv.Atoi(env.get(name)); err == nil {
+		return v
+	}
+	env.badEnv(name)
+	return def
+}
+
+//Comma separated list, empty entries are skipped
+func (env configEnv) envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(env.get(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+//Comma separated name=url pairs, invalid entries are skipped
+func (env configEnv) envProxies(name string) map[string]*url.URL {
+	proxies := map[string]*url.URL{}
+	for _, v := range env.envList(name) {
+		region, raw, ok := strings.Cut(v, "=")
+		if !ok {
+			env.badEnv(name)
+			continue
+		}
+		if proxy, err := url.Parse(strings.TrimSpace(raw)); err == nil && proxy.Host != "" {
+			proxies[strings.TrimSpace(region)] = proxy
+		} else {
+			env.badEnv(name)
+		}
+	}
+	return proxies
+}
+
+//Comma separated list of ips or cidrs, invalid entries are skipped
+func (env configEnv) envNets(name string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(env.get(name), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			nets = append(nets, n)
+		} else {
+			fmt.Printf("Skip %s entry: %s\n", name, v)
+			env.badEnv(name)
+		}
+	}
+	return nets
+}
+
+func (env configEnv) envDuration(name string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(env.get(name)); err == nil {
+		return v
+	}
+	env.badEnv(name)
+	return def
+}
 
 //Request from client
 type CheckRequest struct {
-	Urls []string
+	//Canonical name is "urls", field names are matched case-insensitively ("Urls" works too)
+	Urls []string `json:"urls"`
+	//JSON list of more urls to check: ["url", ...] or {"urls": [...], "next": "next page url"}
+	UrlsSource string
+	//Check urls one by one, each step must succeed before the next runs
+	Chain bool
+	//Parallel checks of one host, derived from the batch when 0 (see hostLimits)
+	HostConcurrency int
+	//Check urls in random order, results still follow the request order
+	Shuffle bool
+	//Only this many of Urls picked at random (sampleRand) are checked, the list may then exceed UrlLimit
+	Sample int
+	//Serialized response limit, results are dropped (failures kept first) to fit
+	MaxResponseBytes int
+	//Include the effective request (defaults and limits applied, secrets redacted)
+	EchoRequest bool
+	//Include effective_options: the limits and defaults the checks actually ran with
+	ReportOptions bool
+	//Dry run: the outbound request of every url is returned as it would be sent, nothing is checked
+	PreviewRequests bool
+	//Total seconds for the batch, later urls get shorter timeouts to finish within it
+	TimeBudget float64
+	//Url checks started per second over the whole batch, spread evenly instead of bursting, 0 is unpaced
+	RequestsPerSecond float64
+	//Milliseconds at least between check starts on the same host, HostDelays can set it per host
+	HostDelayMs int
+	HostDelays  map[string]int
+	//Unhealthy urls don't fail the batch until there are more than ErrorBudget of them
+	//(or ErrorBudgetPercent of the urls), then the full response comes with 424
+	ErrorBudget        *int
+	ErrorBudgetPercent *float64
+	//JSON response is also uploaded to the S3 bucket in background, the key is in the response
+	Archive bool
+	//Results are streamed as a JSON array in completion order (not sorted or limited),
+	//a failed url doesn't turn the response into a 400 nor stop the other urls
+	Stream bool
+	//Streamed array ends with {"done": true, "urls": [...]}: all results in order, sorted by SortBy
+	StreamSummary bool
+	//Results with the same code and health are grouped (large homogeneous batches)
+	Collapse bool
+	//Results are nested under their host with a summary per host, instead of the flat urls list
+	GroupByHost bool
+	//Results keyed by url instead of the list, the urls must be unique
+	MapByUrl bool
+	//Results order: latency_desc, status, url (request order when empty)
+	SortBy string
+	//Expected code per url, results with another code are flagged changed
+	Baseline map[string]int
+	//Normalized request and response format, ETags are kept under it (ETAG_TTL)
+	etagKey string
+	//Indexes in the request Urls of the ones Sample picked
+	sampled []int
+	//Response gets a pass/fail verdict by this criterion, see verdictRules
+	Verdict string
+	CheckOptions
+}
+
+func (r CheckRequest) hasErrorBudget() bool {
+	return r.ErrorBudget != nil || r.ErrorBudgetPercent != nil
+}
+
+//More unhealthy urls than either of the budgets allows
+func (r CheckRequest) overBudget(results []UrlCheckResult) bool {
+	unhealthy := 0
+	for _, result := range results {
+		if !result.Healthy {
+			unhealthy++
+		}
+	}
+
+	if r.ErrorBudget != nil && unhealthy > *r.ErrorBudget {
+		return true
+	}
+	return r.ErrorBudgetPercent != nil && len(results) > 0 &&
+		float64(unhealthy)*100/float64(len(results)) > *r.ErrorBudgetPercent
+}
+
+//Options applied to every url check of a request
+type CheckOptions struct {
+	//Https response must send Strict-Transport-Security with max-age >= HSTSMinAge seconds
+	RequireHSTS bool
+	HSTSMinAge  int64
+	//Merged into the query string of every url (cache busting, parameterized checks)
+	QueryParams map[string]string
+	//Failed check is repeated up to this many times (RetryLimit) with exponential backoff
+	Retries int
+	//Backoff jitter: full (default), equal or none
+	RetryJitter string
+	//Responses with these codes are retried too (503 while deploying), the last one is the result
+	RetryStatuses []int
+	//Redirects are followed unless set to false
+	FollowRedirects *bool
+	//Any 3xx response is unhealthy (canonical urls monitoring)
+	RedirectsUnhealthy bool
+	//Redirects to plain http are refused (downgrade)
+	HTTPSOnlyRedirects bool
+	//GET with redirects followed, the final body is read to the end into io.Discard whatever its
+	//Content-Length: real size and early closes (partial_response) without buffering.
+	//Refused with options that look into the body
+	DiscardBody bool
+	//Url must redirect (first hop) exactly to this Location, redirects are not followed
+	ExpectRedirectTo string
+	//Download of a url is aborted past this many body bytes, 0 is BodyLimit only
+	MaxBytes int64
+	//Body must be exactly this many bytes (after decoding), 0 requires an empty body
+	ExpectBodyBytes *int
+	//More response header lines than this make the url unhealthy, 0 is unlimited
+	MaxHeaders int
+	//Report stapled OCSP response status of https urls
+	ReportOCSP bool
+	//Report how old the response is from its Date and Age headers (caching audits)
+	ReportAge bool
+	//Report the size of the request sent, request line, headers and body (upload monitoring)
+	ReportRequestBytes bool
+	//Good staple with thisUpdate older than this many seconds is reported stale (with a warning)
+	OCSPMaxAge int64
+	//Each url is checked this many times in a row (up to SampleLimit)
+	Samples int
+	//Connection failure is healthy, any response is not (firewall checks)
+	ExpectUnreachable bool
+	//Failures of these error kinds are healthy (f.e. dns_not_found for a decommissioned host)
+	HealthyKinds []string
+	//Response trailers included in the result
+	Trailers []string
+	//Sent with every request (content negotiation checks), the negotiated
+	//Content-Type/Content-Language are reported
+	Accept         string
+	AcceptLanguage string
+	//Sha256 of the body in the result, urls serving the same content are grouped in the response
+	HashBody bool
+	//First lines of a text body returned in the result (version banners)
+	ReturnBodyLines int
+	//HTML <meta http-equiv="refresh"> target is reported, refreshing to the page itself fails the check
+	CheckMetaRefresh bool
+	//Body must be JSON valid against this schema, inline or the url of one as a string
+	ExpectJSONSchema json.RawMessage
+	//Advisory warning rules (see warningRules), they never make a url unhealthy
+	WarnOn []string
+	//TLS handshakes over this many milliseconds warn and make the url degraded, WarnOn or not.
+	//When 0 the slow_tls rule uses SlowTLSHandshake and only warns
+	SlowTLSMs int
+	//Each url is checked through each of these region proxies (REGION_PROXIES)
+	Regions []string
+	//Url is checked forced to HTTP/1.1 as well, a different status code is flagged (ALPN/h2 problems)
+	CompareProtocols bool
+	//Only HTTP/1.1 is offered
+	http1 bool
+	//Https urls are checked over HTTP/3 (QUIC) as well, reported apart and never failing the url
+	CheckHTTP3 bool
+	//Alternative services the response advertises (Alt-Svc) are reported, nothing is tried
+	ReportAltSvc bool
+	//Wall clock start and end of each url check are reported (timelines)
+	ReportTimestamps bool
+	//Request goes over QUIC
+	http3 bool
+	//TLS SNI (and certificate name) sent instead of the url host
+	ServerName string
+	//Url is checked with HEAD as well, a different status code is flagged
+	CompareMethods bool
+	//Url is checked with the trailing slash toggled as well (/path and /path/), a different status code is flagged
+	CompareSlashes bool
+	//Request method (GET when empty, see allowedMethods) and its body
+	Method   string
+	Body     string
+	BodyType string
+	//W3C traceparent sent with every url: the /check request's trace continued (or a new one), a span per url
+	TraceParent bool
+	//User-Agent of each url is picked at random from these (userAgentRand), reported in the result
+	UserAgents []string
+	//Body is sent with Expect: 100-continue, it goes anyway after ExpectContinueWait without a 100
+	ExpectContinue bool
+	//Per url timeout in milliseconds instead of UrlTimeout, raised to MIN_TIMEOUT when lower
+	TimeoutMs int
+	//Shorter than the url timeout when a TimeBudget is running out
+	timeout time.Duration
+	//TimeoutMs or the budget share was raised to MIN_TIMEOUT
+	timeoutClamped bool
+	//Time from the batch start to a free slot, reported as QueueWait
+	queueWait time.Duration
+	//Picked from UserAgents for the url
+	userAgent string
+	//Trace id and flags of the batch, traceparent of the url (TraceParent)
+	trace       string
+	traceParent string
+	//Compiled ExpectJSONSchema
+	jsonSchema *jsonschema.Schema
+	//Config of the batch, the live one when nil (scheduled checks)
+	config *Config
+	//Region proxy transport, the shared one when nil
+	transport *http.Transport
+	//Cookies shared between steps of a chain
+	jar http.CookieJar
+}
+
+//Options with defaults filled and limits applied, as they are actually used
+func (o CheckOptions) normalized() CheckOptions {
+	config := o.settings()
+	if o.Samples < 1 {
+		o.Samples = 1
+	}
+	if o.Samples > SampleLimit {
+		o.Samples = SampleLimit
+	}
+
+	if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.Retries > RetryLimit {
+		o.Retries = RetryLimit
+	}
+	if o.RetryJitter != "equal" && o.RetryJitter != "none" {
+		o.RetryJitter = "full"
+	}
+
+	follow := o.followRedirects()
+	o.FollowRedirects = &follow
+
+	if o.Body != "" && o.BodyType == "" {
+		o.BodyType = "application/json"
+	}
+
+	if o.TimeoutMs < 0 {
+		o.TimeoutMs = 0
+	}
+	if o.TimeoutMs > 0 && time.Duration(o.TimeoutMs) * time.Millisecond < config.MinTimeout {
+		o.TimeoutMs = int(config.MinTimeout / time.Millisecond)
+		o.timeoutClamped = true
+	}
+
+	if o.HSTSMinAge <= 0 {
+		o.HSTSMinAge = HSTSMinAge
+	}
+
+	return o
+}
+
+//Reloads apply to batches started after them
+func (o CheckOptions) settings() *Config {
+	if o.config != nil {
+		return o.config
+	}
+	return currentConfig()
+}
+
+func (o CheckOptions) followRedirects() bool {
+	if o.ExpectRedirectTo != "" {
+		return false
+	}
+	return o.FollowRedirects == nil || *o.FollowRedirects
+}
+
+func (o CheckOptions) slowTLS() time.Duration {
+	if o.SlowTLSMs > 0 {
+		return time.Duration(o.SlowTLSMs) * time.Millisecond
+	}
+	return SlowTLSHandshake
+}
+
+func (o CheckOptions) urlTimeout() time.Duration {
+	if o.TimeoutMs > 0 {
+		return time.Duration(o.TimeoutMs) * time.Millisecond
+	}
+	return UrlTimeout
+}
+
+/**
+	"<trace id>-<flags>" of a valid incoming traceparent (00-trace-parent-flags),
+	else of a new sampled trace, so all checks of a batch land in one trace.
+ */
+func batchTrace(r *http.Request) string {
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("Traceparent")), "-")
+	if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" && isHex(parts[0]) &&
+		len(parts[1]) == 32 && isHex(parts[1]) && strings.Trim(parts[1], "0") != "" &&
+		len(parts[2]) == 16 && isHex(parts[2]) && len(parts[3]) == 2 && isHex(parts[3]) {
+		return strings.ToLower(parts[1] + "-" + parts[3])
+	}
+	return randomHex(16) + "-01"
+}
+
+//New span id per url
+func newTraceParent(trace string) string {
+	traceID, flags, _ := strings.Cut(trace, "-")
+	return "00-" + traceID + "-" + randomHex(8) + "-" + flags
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		//Ids must not be all zeros
+		b[0] = 1
+	}
+	return hex.EncodeToString(b)
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+//Every request of the url (retries, samples, compare variants) sends the same one
+func (o CheckOptions) pickUserAgent() CheckOptions {
+	if len(o.UserAgents) > 0 {
+		o.userAgent = o.UserAgents[userAgentRand.Intn(len(o.UserAgents))]
+	}
+	return o
+}
+
+func (o CheckOptions) roundTripper() *http.Transport {
+	if o.transport != nil {
+		return o.transport
+	}
+	return transport
+}
+
+//Methods a check can use and whether they may carry a body
+var allowedMethods = map[string]bool{
+	http.MethodGet:     false,
+	http.MethodHead:    false,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+func (o CheckOptions) methodError() string {
+	method := o.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	withBody, ok := allowedMethods[method]
+	if !ok {
+		return "method " + method + " not allowed"
+	}
+	if o.Body != "" && !withBody {
+		return "method " + method + " can't have a body"
+	}
+	if o.ExpectContinue && o.Body == "" {
+		return "ExpectContinue needs a body"
+	}
+	return ""
+}
+
+//Options that look into the body content have to be listed here
+func (o CheckOptions) needsBody() bool {
+	//Trailers arrive only after the whole body is read
+	return len(o.Trailers) > 0 || o.ReturnBodyLines > 0 || o.HashBody || o.CheckMetaRefresh ||
+		len(o.ExpectJSONSchema) > 0
+}
+
+//Response to client
+type CheckResponse struct {
+	Urls []UrlCheckResult `json:"urls"`
+	//Body hash to urls, for hashes more urls share (HashBody)
+	Duplicates map[string][]string `json:"duplicates,omitempty"`
+	//Results grouped by code and health instead of urls (Collapse)
+	Groups []ResultGroup `json:"groups,omitempty"`
+	//Results per host instead of urls (GroupByHost)
+	Hosts map[string]*HostGroup `json:"hosts,omitempty"`
+	//Results by url instead of the list (MapByUrl)
+	ByUrl map[string]UrlCheckResult `json:"by_url,omitempty"`
+	//pass or fail by the request Verdict criterion
+	Verdict string `json:"verdict,omitempty"`
+	//Batch deadline expired, not all urls were checked
+	Partial bool `json:"partial,omitempty"`
+	//Why the batch stopped early, batch_timeout for partial responses
+	Cause string `json:"cause,omitempty"`
+	//Results were dropped to fit MaxResponseBytes
+	Truncated bool `json:"truncated,omitempty"`
+	//Object key the response is archived under (Archive)
+	ArchiveKey string `json:"archive_key,omitempty"`
+	//Unhealthy urls went over the request error budget (status 424)
+	OverBudget bool `json:"over_budget,omitempty"`
+	//Effective request (EchoRequest)
+	Request *CheckRequest `json:"request,omitempty"`
+	//Values applied after clamping and defaults (ReportOptions)
+	EffectiveOptions *EffectiveOptions `json:"effective_options,omitempty"`
+	//Request Urls indexes Sample checked, result indexes are into this list
+	Sampled []int `json:"sampled,omitempty"`
+	//Parallel limits applied and the max of checks actually run at once
+	Concurrency     int   `json:"concurrency"`
+	HostConcurrency int   `json:"host_concurrency"`
+	MaxInFlight     int32 `json:"max_in_flight"`
+}
+
+//Times in seconds, TimeBudget shares can still shorten single url timeouts
+type EffectiveOptions struct {
+	Timeout         float64 `json:"timeout"`
+	TimeoutClamped  bool    `json:"timeout_clamped,omitempty"`
+	TimeBudget      float64 `json:"time_budget,omitempty"`
+	Concurrency     int     `json:"concurrency"`
+	HostConcurrency int     `json:"host_concurrency"`
+	Retries         int     `json:"retries"`
+	RetryJitter     string  `json:"retry_jitter"`
+	FollowRedirects bool    `json:"follow_redirects"`
+	Samples         int     `json:"samples"`
+	MaxBytes        int64   `json:"max_bytes"`
+}
+
+func effectiveOptions(req CheckRequest, response CheckResponse) *EffectiveOptions {
+	config := req.settings()
+	maxBytes := config.BodyLimit
+	if req.MaxBytes > 0 && req.MaxBytes < maxBytes {
+		maxBytes = req.MaxBytes
+	}
+	return &EffectiveOptions{
+		Timeout: req.urlTimeout().Seconds(),
+		TimeoutClamped: req.timeoutClamped,
+		TimeBudget: req.TimeBudget,
+		Concurrency: response.Concurrency,
+		HostConcurrency: response.HostConcurrency,
+		Retries: req.Retries,
+		RetryJitter: req.RetryJitter,
+		FollowRedirects: req.followRedirects(),
+		Samples: req.Samples,
+		MaxBytes: maxBytes,
+	}
+}
+
+//PreviewRequests response
+type PreviewResponse struct {
+	Requests []PreviewedRequest `json:"requests"`
+}
+
+//Request line and headers as written to the wire (body left out), secrets redacted
+type PreviewedRequest struct {
+	Index   int    `json:"index"`
+	Method  string `json:"method"`
+	Url     string `json:"url"`
+	Request string `json:"request,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+//Identical results of a collapsed batch, one of them as the sample
+type ResultGroup struct {
+	Code    int            `json:"code"`
+	Healthy bool           `json:"healthy"`
+	Count   int            `json:"count"`
+	Sample  UrlCheckResult `json:"sample"`
+}
+
+//Results of one host, in the response order
+type HostGroup struct {
+	Urls      []UrlCheckResult `json:"urls"`
+	Healthy   int              `json:"healthy"`
+	Unhealthy int              `json:"unhealthy"`
+	//Times of the checked urls
+	Latency *LatencyStats `json:"latency,omitempty"`
+}
+
+//Url
+type Url struct {
+	path string
+	//Position in request urls
+	index int
+}
+
+//Url with check result
+type UrlCheckResult struct {
+	Url *Url `json:"url"`
+	Code int `json:"code"`
+	//Reason phrase as sent by the server
+	StatusText string `json:"status_text"`
+	Message  string `json:"message"`
+	Time     float64
+	//Seconds to the first response byte (first chunk), Time covers the whole body
+	TTFB float64 `json:"ttfb,omitempty"`
+	//User-Agent sent, only with UserAgents
+	UserAgent string `json:"user_agent,omitempty"`
+	//traceparent header sent, only with TraceParent
+	TraceParent string `json:"traceparent,omitempty"`
+	//Seconds from the batch start to the check start (parallel limits, pacing), not part of Time
+	QueueWait float64 `json:"queue_wait,omitempty"`
+	//RFC3339Nano UTC span of the url check with retries, samples and variants (ReportTimestamps)
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	//Phases in seconds (last hop), filled up to the point a failed check got
+	DNSTime     float64 `json:"dns_time,omitempty"`
+	ConnectTime float64 `json:"connect_time,omitempty"`
+	TLSTime     float64 `json:"tls_time,omitempty"`
+	Healthy  bool `json:"healthy"`
+	//Position of the url in the request, kept when results are reordered
+	Index int `json:"index"`
+	ErrorKind string `json:"error_kind,omitempty"`
+	Trailers map[string]string `json:"trailers,omitempty"`
+	//Internationalized host as given and the punycode form actually requested
+	IdnHost      string `json:"idn_host,omitempty"`
+	PunycodeHost string `json:"punycode_host,omitempty"`
+	//Stapled OCSP: none, good, stale, revoked, unknown or invalid (only with ReportOCSP)
+	OCSPStatus string `json:"ocsp_status,omitempty"`
+	//Server sent 103 Early Hints before the final response (Code is always the final status)
+	EarlyHints bool `json:"early_hints,omitempty"`
+	//Server answered 100 Continue before the body was sent (only with ExpectContinue)
+	GotContinue *bool `json:"got_continue,omitempty"`
+	//Connection came from the keep-alive pool (last hop for redirects)
+	ConnReused bool `json:"conn_reused"`
+	//Host was resolved from the dns cache (DNS_CACHE_TTL)
+	DNSCached bool `json:"dns_cached,omitempty"`
+	//Ip the check actually connected to (last hop for redirects)
+	RemoteIP string `json:"remote_ip"`
+	//TLS server name actually sent (last hop for redirects)
+	SNI string `json:"sni,omitempty"`
+	//Redirect hops followed, 0 when none
+	RedirectCount int `json:"redirect_count"`
+	//Where followed redirects ended, only when it differs from the url
+	FinalUrl string `json:"final_url,omitempty"`
+	//Timeout the check got when TimeBudget shortened it, seconds
+	ShortenedTimeout float64 `json:"shortened_timeout,omitempty"`
+	//Requested or budgeted timeout was below MIN_TIMEOUT and raised to it
+	TimeoutClamped bool `json:"timeout_clamped,omitempty"`
+	//Hex sha256 of the body (HashBody)
+	BodyHash string `json:"body_hash,omitempty"`
+	//Bytes of the first request in HTTP/1.1 form, headers and body (ReportRequestBytes)
+	RequestBytes int `json:"request_bytes,omitempty"`
+	//Response header lines, repeated headers counted each time (only with MaxHeaders)
+	HeaderCount int `json:"header_count,omitempty"`
+	//Meta refresh target of an HTML page, absolute (CheckMetaRefresh)
+	MetaRefresh string `json:"meta_refresh,omitempty"`
+	//Where the body breaks ExpectJSONSchema, "instance location: error" (up to SchemaErrorLimit)
+	SchemaErrors []string `json:"schema_errors,omitempty"`
+	//First ReturnBodyLines lines of a text body and the number of lines it has
+	BodyLines []string `json:"body_lines,omitempty"`
+	LineCount int      `json:"line_count,omitempty"`
+	//Soft issues found by the WarnOn rules, healthy stays as it is
+	Warnings []string `json:"warnings,omitempty"`
+	//Healthy but past a threshold (SlowTLSMs, stale OCSP staple), other warnings don't count
+	Degraded bool `json:"degraded,omitempty"`
+	//Result was cut to ResultLimit
+	Truncated bool `json:"truncated,omitempty"`
+	//Code differs from the request Baseline
+	Changed bool `json:"changed,omitempty"`
+	//Negotiated content, only with the Accept or AcceptLanguage options
+	ContentType     string `json:"content_type,omitempty"`
+	ContentLanguage string `json:"content_language,omitempty"`
+	//CDN cache result from cache headers: hit, miss or stale
+	CacheStatus string `json:"cache_status,omitempty"`
+	//Seconds since the response was generated at the origin (ReportAge), 0 without Date and Age
+	ResponseAge float64 `json:"response_age,omitempty"`
+	//Location actually sent, only with ExpectRedirectTo
+	Location string `json:"location,omitempty"`
+	//Attempts made, only when Retries are set
+	Attempts int `json:"attempts,omitempty"`
+	//Code of every attempt in order (10 for failed requests), the last is Code
+	AttemptStatuses []int `json:"attempt_statuses,omitempty"`
+	//Set by result hooks
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+	//Latency of all samples, only when Samples > 1
+	Latency *LatencyStats `json:"latency,omitempty"`
+	//Protocol of the response (HTTP/1.1, HTTP/2.0)
+	Proto string `json:"proto,omitempty"`
+	//Forced HTTP/1.1 check of the url and whether its code differs (CompareProtocols)
+	HTTP1         *UrlCheckResult `json:"http1,omitempty"`
+	ProtoMismatch bool            `json:"proto_mismatch,omitempty"`
+	//Check of the url over HTTP/3, healthy when h3 is reachable, and whether Alt-Svc offers h3 (CheckHTTP3)
+	HTTP3        *UrlCheckResult `json:"http3,omitempty"`
+	H3Advertised bool            `json:"h3_advertised,omitempty"`
+	//Alt-Svc of the response, repeated headers joined (ReportAltSvc)
+	AltSvc string `json:"alt_svc,omitempty"`
+	//HEAD check of the url and whether its code differs from GET (CompareMethods)
+	Head           *UrlCheckResult `json:"head,omitempty"`
+	MethodMismatch bool            `json:"method_mismatch,omitempty"`
+	//Check of the url with the trailing slash toggled and whether its code differs (CompareSlashes)
+	Slash         *UrlCheckResult `json:"slash,omitempty"`
+	SlashMismatch bool            `json:"slash_mismatch,omitempty"`
+	//Region the check ran through and the results of every region (Regions option)
+	Region  string                    `json:"region,omitempty"`
+	Regions map[string]UrlCheckResult `json:"regions,omitempty"`
+	//A threshold rule was hit, Degraded when the url is healthy
+	degraded bool
+}
+
+//Latency jitter of url samples, seconds
+type LatencyStats struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+}
+
+//Machine readable reasons of failed checks
+const (
+	ErrorKindPartialResponse = "partial_response"
+	ErrorKindReachable       = "reachable"
+	ErrorKindTlsUntrusted    = "tls_untrusted"
+	ErrorKindRedirectLoop    = "redirect_loop"
+	ErrorKindByteBudget      = "byte_budget_exceeded"
+	ErrorKindRedirect        = "redirect"
+	ErrorKindDNSTimeout      = "dns_timeout"
+	ErrorKindUrlTimeout      = "url_timeout"
+	ErrorKindBatchTimeout    = "batch_timeout"
+	ErrorKindClientCanceled  = "client_canceled"
+	ErrorKindCanceled        = "canceled"
+	ErrorKindHSTS            = "hsts"
+	ErrorKindPanic           = "internal_error"
+	ErrorKindTooManyFiles    = "too_many_open_files"
+	ErrorKindRedirectTarget  = "redirect_target"
+	ErrorKindMetaRefreshLoop = "meta_refresh_loop"
+	ErrorKindTooManyHeaders  = "too_many_headers"
+	ErrorKindDowngrade       = "downgrade_redirect"
+	ErrorKindBadEncoding     = "bad_encoding"
+	ErrorKindDNSNotFound     = "dns_not_found"
+	ErrorKindNotAttempted    = "not_attempted"
+	ErrorKindQueueTimeout    = "queue_timeout"
+	ErrorKindSNIRequired     = "sni_required"
+	ErrorKindNotJSON         = "not_json"
+	ErrorKindSchemaMismatch  = "schema_mismatch"
+	ErrorKindBodySize        = "body_size_mismatch"
+	ErrorKindConnectFailed   = "connect_failed"
+)
+
+//Why a batch stopped early, the cause field of failed and partial responses
+const (
+	CauseClientDisconnect = "client_disconnect"
+	CauseBatchTimeout     = "batch_timeout"
+	CauseFailFast         = "fail_fast"
+)
+
+/**
+	HTTP server limit (f.e.  100 connection per second)
+ */
+var limiter = rate.NewLimiter(HttpLimitPerSecons, HttpLimitPerSeconsBoost)
+func limit(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if validKey(r, config.TrustedKeys) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if limiter.Allow() == false || ipLimiters.allow(clientIp(r)) == false {
+			http.Error(w, http.StatusText(429), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+	Optional api key auth, so the server can't be used as an open fetch proxy.
+	Health endpoints stay open.
+ */
+func auth(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if len(config.ApiKeys) > 0 && !validKey(r, config.ApiKeys) && !validKey(r, config.TrustedKeys) {
+			http.Error(w, http.StatusText(401), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Admin endpoints need an admin key, without ADMIN_KEYS they don't exist
+func admin(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if len(config.AdminKeys) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		if !validKey(r, config.AdminKeys) {
+			http.Error(w, http.StatusText(401), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+	Planned maintenance: /check answers 503 with Retry-After, health endpoints keep
+	answering and tell the mode. Switched by POST /admin/maintenance, SIGUSR1 or MAINTENANCE.
+ */
+var maintenance atomic.Bool
+
+func underMaintenance(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maintenance.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(MaintenanceRetryAfter / time.Second)))
+			http.Error(w, "{'error' : 'maintenance'}", http.StatusServiceUnavailable)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setMaintenance(on bool) {
+	if maintenance.Swap(on) != on {
+		fmt.Printf("Maintenance: %t\n", on)
+	}
+}
+
+type MaintenanceResponse struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+//POST /admin/maintenance?on=true|false, GET tells the current mode
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			on, err := strconv.ParseBool(r.URL.Query().Get("on")); if err != nil {
+				http.Error(w, "{'error' : 'on must be true or false'}", http.StatusBadRequest)
+				return
+			}
+			setMaintenance(on)
+		default:
+			http.Error(w, http.StatusText(405), http.StatusMethodNotAllowed)
+			return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(MaintenanceResponse{Maintenance: maintenance.Load()})
+}
+
+var reloadMu sync.Mutex
+
+//Values of accepted reload bodies, under reloadMu
+var reloadOverrides = map[string]string{}
+
+type ReloadResponse struct {
+	//Changed env values used only at start, the running ones are kept until a restart
+	Restart []string `json:"restart,omitempty"`
+}
+
+/**
+	POST /admin/reload reads the config from the environment again and swaps it in whole,
+	running batches finish with theirs. A body of NAME=value lines (env file, # comments)
+	overrides the environment, for this and later reloads (the process env is untouched).
+	Only names of the config are taken, an unknown one or any bad value refuses the reload.
+ */
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(405), http.StatusMethodNotAllowed)
+		return
+	}
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(io.LimitReader(r.Body, UploadLimit))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			http.Error(w, "{'error' : 'bad line " + line + "'}", http.StatusBadRequest)
+			return
+		}
+		vars[name] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	known := configNames()
+	overrides := map[string]string{}
+	for name, value := range reloadOverrides {
+		overrides[name] = value
+	}
+	for name, value := range vars {
+		if !known[name] {
+			http.Error(w, "{'error' : 'unknown key " + name + "'}", http.StatusBadRequest)
+			return
+		}
+		overrides[name] = value
+	}
+
+	fresh := loadConfig(overrides)
+	err := fresh.validate()
+	if len(envProblems) > 0 {
+		err = fmt.Errorf("bad value of %s", strings.Join(envProblems, ", "))
+	}
+	if err != nil {
+		http.Error(w, "{'error' : '" + err.Error() + "'}", http.StatusBadRequest)
+		return
+	}
+	reloadOverrides = overrides
+
+	running := currentConfig()
+	restart := fresh.keepStartup(running)
+	liveConfig.Store(&fresh)
+	fmt.Println("Config reloaded.")
+
+	//A changed MAINTENANCE switches the mode, otherwise the admin or SIGUSR1 setting stays
+	if fresh.Maintenance != running.Maintenance {
+		setMaintenance(fresh.Maintenance)
+	}
+	//Client limiters keep their rate, new ones are made on the next request
+	if fresh.IpLimitPerSecond != running.IpLimitPerSecond || fresh.IpLimitBoost != running.IpLimitBoost {
+		ipLimiters.reset()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ReloadResponse{Restart: restart})
+}
+
+//X-Api-Key is one of the keys, compared in constant time
+func validKey(r *http.Request, keys []string) bool {
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		return false
+	}
+
+	valid := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+/**
+	Per client ip limit, so one noisy client can't starve others.
+	The global limiter above stays the ceiling.
+ */
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type ipLimiterStore struct {
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+var ipLimiters = &ipLimiterStore{limiters: map[string]*ipLimiter{}}
+
+func (s *ipLimiterStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limiters = map[string]*ipLimiter{}
+}
+
+func (s *ipLimiterStore) allow(ip string) bool {
+	config := currentConfig()
+	if config.IpLimitPerSecond <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > config.IpLimitIdle {
+		for key, l := range s.limiters {
+			if now.Sub(l.lastSeen) > config.IpLimitIdle {
+				delete(s.limiters, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	l, ok := s.limiters[ip]
+	if !ok {
+		l = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(config.IpLimitPerSecond), config.IpLimitBoost)}
+		s.limiters[ip] = l
+	}
+	l.lastSeen = now
+
+	return l.limiter.Allow()
+}
+
+/**
+	Client ip is RemoteAddr, X-Forwarded-For is honored only when the request
+	came from a trusted proxy (otherwise anyone could spoof it).
+	The header is walked from the right, skipping our own proxies.
+ */
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr); if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !trustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(host string) bool {
+	config := currentConfig()
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range config.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Hint for first-time users at /
+type IndexResponse struct {
+	Version   string            `json:"version"`
+	Endpoints map[string]string `json:"endpoints"`
+}
+
+/**
+	Serves / by itself, so the hint is not rate limited.
+ */
+func index(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if r.URL.Path != "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		endpoints := map[string]string{
+			"POST /check": `check urls, body: {"urls": ["https://example.com"]}`,
+			"GET /check": "check urls, ?urls=https://example.com,https://example.org",
+			"GET /debug/vars": "metrics",
+			"GET /readyz": "readiness, 503 while starting or draining, maintenance in maintenance mode",
+			"GET /healthz": "liveness, ?deep=true 503 when recent url checks mostly fail, maintenance in maintenance mode",
+			"GET /status": "latest results of scheduled checks",
+		}
+		if len(config.ApiKeys) > 0 {
+			endpoints["POST /check"] += ", X-Api-Key header required"
+			endpoints["GET /check"] += ", X-Api-Key header required"
+		}
+		if config.Debug {
+			endpoints["GET /benchmark"] = "local self-test, ?n=100 checks"
+		}
+		if len(config.AdminKeys) > 0 {
+			endpoints["POST /admin/maintenance"] = "?on=true 503 for /check (maintenance), ?on=false back, admin X-Api-Key required"
+			endpoints["POST /admin/reload"] = "re-read config from env, body of NAME=value lines sets them first, admin X-Api-Key required"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(IndexResponse{Version: VERSION, Endpoints: endpoints})
+	})
+}
+
+//Set once the listener is bound and the server is fully up, unset on shutdown
+var ready atomic.Bool
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	//Still ready, clients should get the 503 with Retry-After instead of another instance
+	if maintenance.Load() {
+		_, _ = fmt.Fprint(w, "maintenance")
+		return
+	}
+	_, _ = fmt.Fprint(w, "ok")
+}
+
+//Recent outbound check outcomes in buckets (HealthWindow / healthBuckets each)
+const healthBuckets = 60
+
+type successWindow struct {
+	mu      sync.Mutex
+	buckets [healthBuckets]struct {
+		slot       int64
+		ok, failed int
+	}
+}
+
+var outbound = &successWindow{}
+
+func (s *successWindow) slot(now time.Time) int64 {
+	config := currentConfig()
+	size := config.HealthWindow / healthBuckets
+	if size <= 0 {
+		size = time.Second
+	}
+	return now.UnixNano() / int64(size)
+}
+
+//Urls that didn't get a real answer because the batch ended are not outbound failures
+func (s *successWindow) record(result UrlCheckResult) {
+	switch result.ErrorKind {
+		case ErrorKindCanceled, ErrorKindClientCanceled, ErrorKindBatchTimeout:
+			return
+	}
+
+	slot := s.slot(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := &s.buckets[slot%healthBuckets]
+	if bucket.slot != slot {
+		bucket.slot, bucket.ok, bucket.failed = slot, 0, 0
+	}
+	if result.Healthy {
+		bucket.ok++
+	} else {
+		bucket.failed++
+	}
+}
+
+func (s *successWindow) rate() (float64, int) {
+	slot := s.slot(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ok, total int
+	for _, bucket := range s.buckets {
+		if slot-bucket.slot < healthBuckets {
+			ok += bucket.ok
+			total += bucket.ok + bucket.failed
+		}
+	}
+	if total == 0 {
+		return 1, 0
+	}
+	return float64(ok) / float64(total), total
+}
+
+type HealthResponse struct {
+	Status      string  `json:"status"`
+	SuccessRate float64 `json:"success_rate"`
+	Checks      int     `json:"checks"`
+}
+
+/**
+	Liveness, with ?deep=true also the recent url check success rate:
+	degraded (503) below HealthMinSuccess, an upstream-wide problem.
+ */
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	config := currentConfig()
+	if r.URL.Query().Get("deep") != "true" {
+		if maintenance.Load() {
+			_, _ = fmt.Fprint(w, "maintenance")
+			return
+		}
+		_, _ = fmt.Fprint(w, "ok")
+		return
+	}
+
+	rate, checks := outbound.rate()
+	health := HealthResponse{Status: "ok", SuccessRate: rate, Checks: checks}
+	w.Header().Set("Content-Type", "application/json")
+	if maintenance.Load() {
+		health.Status = "maintenance"
+	} else if checks >= HealthMinChecks && rate < config.HealthMinSuccess {
+		health.Status = "degraded"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(health)
+}
+
+/**
+	Readiness goes 503 first and load balancers get DrainPeriod
+	to stop routing here, only then the server is shut down.
+ */
+func shutdown(server *http.Server) error {
+	config := currentConfig()
+	ready.Store(false)
+	if config.DrainPeriod > 0 {
+		fmt.Printf("Draining %s...\n", config.DrainPeriod)
+		time.Sleep(config.DrainPeriod)
+	}
+
+	return server.Shutdown(context.Background())
+}
+
+func main() {
+	config := currentConfig()
+	mux := http.NewServeMux()
+	mux.Handle("/check", underMaintenance(auth(http.HandlerFunc(checkHandler))))
+	mux.Handle("/admin/maintenance", admin(http.HandlerFunc(maintenanceHandler)))
+	mux.Handle("/admin/reload", admin(http.HandlerFunc(reloadHandler)))
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/status", statusHandler)
+	if config.Debug {
+		//Runs real checks, same key as /check
+		mux.Handle("/benchmark", auth(http.HandlerFunc(benchmarkHandler)))
+	}
+
+	//Background checks stop with the server
+	background, stopBackground := context.WithCancel(context.Background())
+	if len(config.ScheduleUrls) > 0 {
+		go schedule.run(background, config.ScheduleUrls, config.ScheduleInterval)
+	}
+
+	//Health endpoints are not rate limited
+	unlimited := http.NewServeMux()
+	unlimited.HandleFunc("/readyz", readyzHandler)
+	unlimited.HandleFunc("/healthz", healthzHandler)
+	unlimited.Handle("/", index(limit(mux)))
+
+	server := &http.Server{
+		Addr: PORT,
+		Handler: unlimited,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: config.WriteTimeout,
+	}
+
+	//Graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	//kill -USR1 flips maintenance mode
+	maintenance.Store(config.Maintenance)
+	toggle := make(chan os.Signal, 1)
+	signal.Notify(toggle, syscall.SIGUSR1)
+	go func() {
+		for range toggle {
+			setMaintenance(!maintenance.Load())
+		}
+	}()
+
+	ln, err := net.Listen("tcp", server.Addr); if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Error: %v\n", err)
+			stop <- os.Kill
+		}
+	}()
+
+	//Ready once the warm-up is done, checks are served meanwhile
+	go func() {
+		warmUp(background, config.WarmUrls)
+		if background.Err() == nil {
+			ready.Store(true)
+		}
+	}()
+	fmt.Println("Server started.")
+
+	<-stop
+	stopBackground()
+
+	if err := shutdown(server); err != nil {
+		fmt.Println("Server error...")
+	}
+
+	fmt.Println("Server stopped.")
+}
+
+func checkHandler(w http.ResponseWriter, r *http.Request) {
+	//Deadlines count from here, decoding and fetching the urls is part of the batch
+	started := time.Now()
+	//The whole batch runs with the config it started with
+	config := currentConfig()
+	r = r.WithContext(withConfig(r.Context(), config))
+
+	//Decode request
+	var req CheckRequest
+	var err error
+	if r.Method == http.MethodGet {
+		req.Urls = queryUrls(r)
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		req.Urls, err = uploadedUrls(w, r)
+	} else {
+		//Misspelled fields are refused instead of silently ignored: json: unknown field "url"
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&req)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.config = config
+
+	if req.Sample < 0 {
+		http.Error(w, "{'error' : 'negative sample'}", http.StatusBadRequest)
+		return
+	}
+	if req.Sample > 0 && req.Sample < len(req.Urls) {
+		req.Urls, req.sampled = sampleUrls(req.Urls, req.Sample, sampleRand)
+	}
+
+	if len(req.Urls) > UrlLimit {
+		http.Error(w, "{'error' : 'to many urls'}", http.StatusBadRequest)
+		return
+	}
+
+	//Fetching UrlsSource pages and schemas is bound by the batch deadline too
+	batchCtx, cancel, err := batchContext(r, started); if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	if req.UrlsSource != "" {
+		limit := UrlLimit - len(req.Urls)
+		if config.SourceLimit < limit {
+			limit = config.SourceLimit
+		}
+		urls, err := sourceUrls(batchCtx, req.UrlsSource, limit); if err != nil {
+			http.Error(w, "{'error' : 'urls source: " + err.Error() + "'}", http.StatusBadRequest)
+			return
+		}
+		req.Urls = append(req.Urls, urls...)
+	}
+
+	if _, ok := resultSorters[req.SortBy]; !ok && req.SortBy != "" {
+		http.Error(w, "{'error' : 'unknown sort'}", http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := verdictRules[req.Verdict]; !ok && req.Verdict != "" {
+		http.Error(w, "{'error' : 'unknown verdict'}", http.StatusBadRequest)
+		return
+	}
+	if req.Verdict == "error_budget" && !req.hasErrorBudget() {
+		http.Error(w, "{'error' : 'error_budget verdict needs ErrorBudget or ErrorBudgetPercent'}", http.StatusBadRequest)
+		return
+	}
+
+	if req.RequestsPerSecond < 0 {
+		http.Error(w, "{'error' : 'negative requests per second'}", http.StatusBadRequest)
+		return
+	}
+
+	//The read is capped at BODY_LIMIT, a longer body must still read as too long
+	if req.ExpectBodyBytes != nil && (*req.ExpectBodyBytes < 0 || int64(*req.ExpectBodyBytes) >= config.BodyLimit) {
+		http.Error(w, "{'error' : 'ExpectBodyBytes must be below BODY_LIMIT'}", http.StatusBadRequest)
+		return
+	}
+	if req.ExpectBodyBytes != nil && req.MaxBytes > 0 && int64(*req.ExpectBodyBytes) > req.MaxBytes {
+		http.Error(w, "{'error' : 'ExpectBodyBytes over MaxBytes'}", http.StatusBadRequest)
+		return
+	}
+
+	if req.DiscardBody && (req.needsBody() || (req.Method != "" && req.Method != http.MethodGet) || !req.followRedirects()) {
+		http.Error(w, "{'error' : 'DiscardBody needs GET, followed redirects and no body options'}", http.StatusBadRequest)
+		return
+	}
+
+	if req.HostDelayMs < 0 || minValue(req.HostDelays) < 0 {
+		http.Error(w, "{'error' : 'negative host delay'}", http.StatusBadRequest)
+		return
+	}
+
+	if problem := req.methodError(); problem != "" {
+		http.Error(w, "{'error' : '" + problem + "'}", http.StatusBadRequest)
+		return
+	}
+
+	//A chain stops at its first failed step, there's nothing to stream or budget
+	if req.Chain && (req.Stream || req.hasErrorBudget()) {
+		http.Error(w, "{'error' : 'no Stream or ErrorBudget with Chain'}", http.StatusBadRequest)
+		return
+	}
+
+	if layouts := countTrue(req.Collapse, req.GroupByHost, req.MapByUrl); layouts > 1 {
+		http.Error(w, "{'error' : 'only one of Collapse, GroupByHost and MapByUrl'}", http.StatusBadRequest)
+		return
+	}
+
+	if req.MapByUrl {
+		if path := firstDuplicate(req.Urls); path != "" {
+			http.Error(w, "{'error' : 'duplicate url " + path + " with MapByUrl'}", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.Archive && (config.S3Endpoint == "" || config.S3Bucket == "") {
+		http.Error(w, "{'error' : 'archive not configured'}", http.StatusBadRequest)
+		return
+	}
+	//The archived body is the JSON response, other outputs never build it
+	if req.Archive && (req.Stream || acceptsPrometheus(r) || acceptsJUnit(r)) {
+		http.Error(w, "{'error' : 'Archive needs the JSON response, not Stream, Prometheus or JUnit'}", http.StatusBadRequest)
+		return
+	}
+
+	for _, rule := range req.WarnOn {
+		if _, ok := warningRules[rule]; !ok {
+			http.Error(w, "{'error' : 'unknown warning rule " + rule + "'}", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, region := range req.Regions {
+		if _, ok := regionTransports[region]; !ok {
+			http.Error(w, "{'error' : 'unknown region " + region + "'}", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if config.HostLimit > 0 && countHosts(req.Urls) > config.HostLimit {
+		http.Error(w, "{'error' : 'to many hosts'}", http.StatusBadRequest)
+		return
+	}
+
+	req.CheckOptions = req.CheckOptions.normalized()
+	if len(req.ExpectJSONSchema) > 0 {
+		schema, err := compileSchema(batchCtx, req.ExpectJSONSchema); if err != nil {
+			http.Error(w, "{'error' : 'bad json schema: " + err.Error() + "'}", http.StatusBadRequest)
+			return
+		}
+		req.jsonSchema = schema
+	}
+	if req.TraceParent {
+		req.trace = batchTrace(r)
+	}
+
+	if req.PreviewRequests {
+		writePreview(w, r.Context(), req)
+		return
+	}
+
+	if config.ETagTTL > 0 && !req.Stream {
+		req.etagKey = etagKey(r, req)
+		if etag, ok := etags.fresh(req.etagKey, r.Header.Get("If-None-Match")); ok {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if req.Chain {
+		checkChain(w, r, batchCtx, req)
+		return
+	}
+
+	g, ctx := errgroup.WithContext(batchCtx)
+
+	resultChan := make(chan UrlCheckResult)
+	defer close(resultChan)
+
+	//Wait group for urls checks
+	gr := sync.WaitGroup{}
+	gr.Add(len(req.Urls))
+
+	//Parallel limit
+	limitQueue := make(chan string, LimitOutgoingConnections)
+	defer close(limitQueue)
+
+	//Parallel limit per host
+	hostQueues, hostConcurrency := hostLimits(req.Urls, req.HostConcurrency)
+	req.HostConcurrency = hostConcurrency
+	var inFlight, maxInFlight int32
+	budget := newTimeBudget(req.TimeBudget, len(req.Urls), config.MinTimeout)
+	pacer := newPacer(req.RequestsPerSecond)
+	spacing := newHostSpacing(req)
+
+	var stream *arrayStream
+	var streamFailures atomic.Int32
+	if req.Stream {
+		stream = newArrayStream(w, len(req.Urls), cancel)
+	}
+
+	/**
+		Goroutine that handle check result.
+	*/
+	//Results keep the input order whatever the completion order is
+	CheckResult := make([]UrlCheckResult, len(req.Urls))
+	//A panic on one result (a hook dropping its Url) still frees the worker, the batch fails with 500
+	var collectorFailed atomic.Bool
+	collect := func(checkResult UrlCheckResult) {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("Panic in result collector: %v\n%s", p, debug.Stack())
+				collectorFailed.Store(true)
+			}
+			<-limitQueue
+			gr.Done()
+		}()
+
+		CheckResult[checkResult.Url.index] = checkResult
+		stream.write(checkResult)
+	}
+	go func(resultChan chan UrlCheckResult) {
+		for {
+			if checkResult, ok := <-resultChan; ok {
+				if checkResult.Code > 0 {
+					//fmt.Printf("done: %s %d %s\n", checkResult.Url.path, checkResult.Code, checkResult.Message)
+				} else {
+					//fmt.Printf("done (ignore): %s\n", checkResult.Url.path)
+				}
+
+				collect(checkResult)
+			} else {
+				break
+			}
+		}
+	}(resultChan)
+
+	/**
+		Workers that checks urls
+	*/
+	order := scheduleOrder(len(req.Urls), req.Shuffle)
+	queued := time.Now()
+scheduling:
+	for i, index := range order {
+		//Urls not scheduled yet are left empty, the handler doesn't wait for a free slot
+		cutoff := func(err error) {
+			for _, index := range order[i:] {
+				CheckResult[index] = notChecked(Url{path: req.Urls[index], index: index}, ctx, err)
+				gr.Done()
+			}
+			g.Go(func() error {
+				return err
+			})
+		}
+
+		if err := pace(ctx, pacer); err != nil {
+			cutoff(fmt.Errorf("cancelled by client"))
+			break scheduling
+		}
+
+		path := req.Urls[index]
+		select {
+			case limitQueue <- path:
+			case <-ctx.Done():
+				cutoff(fmt.Errorf("cancelled by client"))
+				break scheduling
+		}
+		if err := checkSlots.acquire(ctx); err != nil {
+			<-limitQueue
+			cutoff(err)
+			break scheduling
+		}
+		index := index
+
+		g.Go(func() error {
+			defer checkSlots.release()
+
+			select {
+				case <-ctx.Done():
+					resultChan <- notChecked(Url{path: path, index: index}, ctx, nil)
+					return fmt.Errorf("cancelled by client")
+				default:
+			}
+
+			hostQueue := hostQueues[urlHost(path)]
+			select {
+				case hostQueue <- struct{}{}:
+					defer func() { <-hostQueue }()
+				case <-ctx.Done():
+					resultChan <- notChecked(Url{path: path, index: index}, ctx, nil)
+					return fmt.Errorf("cancelled by client")
+			}
+
+			if err := spacing.wait(ctx, urlHost(path)); err != nil {
+				resultChan <- notChecked(Url{path: path, index: index}, ctx, nil)
+				return fmt.Errorf("cancelled by client")
+			}
+
+			trackInFlight(&inFlight, &maxInFlight, 1)
+			defer trackInFlight(&inFlight, &maxInFlight, -1)
+
+			opts := req.CheckOptions
+			var clamped bool
+			opts.timeout, clamped = budget.timeout(opts.urlTimeout())
+			opts.timeoutClamped = opts.timeoutClamped || clamped
+			opts.queueWait = time.Since(queued)
+			res := CheckUrl(Url{path: path, index: index}, opts, resultChan, ctx)
+			if req.hasErrorBudget() {
+				//Counted at the end instead of failing the batch
+				return nil
+			}
+			if stream != nil {
+				//Just another streamed element, the other urls keep running
+				if res != nil {
+					streamFailures.Add(1)
+				}
+				return nil
+			}
+			return res
+		})
+	}
+
+	if stream != nil {
+		err := g.Wait()
+		gr.Wait()
+		if failures := streamFailures.Load(); err == nil && failures > 0 {
+			err = fmt.Errorf("%d urls failed", failures)
+		}
+		if err != nil {
+			alertFailure(config, err, CheckResult)
+		}
+		if collectorFailed.Load() {
+			stream.fail("internal error")
+			return
+		}
+		var summary *StreamDone
+		if req.StreamSummary {
+			summary = &StreamDone{Done: true, CheckResponse: prepareResponse(req, CheckResponse{
+				Urls: CheckResult,
+				Partial: batchExpired(batchCtx, r),
+				Concurrency: LimitOutgoingConnections,
+				HostConcurrency: hostConcurrency,
+				MaxInFlight: atomic.LoadInt32(&maxInFlight)})}
+		}
+		stream.close(CheckResult, summary)
+		return
+	}
+
+	err = g.Wait()
+	gr.Wait()
+	if collectorFailed.Load() {
+		http.Error(w, "{'error' : 'internal error'}", http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil {
+		if batchExpired(batchCtx, r) {
+			writeCheckResponse(w, r, req, CheckResponse{
+				Urls: CheckResult,
+				Partial: true,
+				Concurrency: LimitOutgoingConnections,
+				HostConcurrency: hostConcurrency,
+				MaxInFlight: atomic.LoadInt32(&maxInFlight)})
+			return
+		}
+
+		//fmt.Printf("Urls has error: %v", err)
+		fmt.Print(".")
+		if err == errBusy {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		alertFailure(config, err, CheckResult)
+		batchFailed(w, ctx, err)
+		return
+	}
+
+	overBudget := req.hasErrorBudget() && req.overBudget(CheckResult)
+	if overBudget {
+		alertFailure(config, fmt.Errorf("error budget exceeded"), CheckResult)
+	}
+	writeCheckResponse(w, r, req, CheckResponse{
+		Urls: CheckResult,
+		OverBudget: overBudget,
+		Concurrency: LimitOutgoingConnections,
+		HostConcurrency: hostConcurrency,
+		MaxInFlight: atomic.LoadInt32(&maxInFlight)})
+}
+
+/**
+	GET /check?urls=a,b,c for plain curl, options need the JSON body.
+	Commas split the list, so urls with commas (and repeated urls params) need encoding.
+ */
+func queryUrls(r *http.Request) []string {
+	var urls []string
+	for _, list := range r.URL.Query()["urls"] {
+		for _, path := range strings.Split(list, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				urls = append(urls, path)
+			}
+		}
+	}
+	return urls
+}
+
+/**
+	Browser upload: "file" field with a url per line, blank lines and # comments
+	are skipped. Up to UploadLimit bytes, reading stops past UrlLimit urls.
+ */
+func uploadedUrls(w http.ResponseWriter, r *http.Request) ([]string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, UploadLimit)
+	file, _, err := r.FormFile("file"); if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() && len(urls) <= UrlLimit {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+//One page of a UrlsSource
+type SourcePage struct {
+	Urls []string `json:"urls"`
+	Next string   `json:"next"`
+}
+
+/**
+	Urls of a remote list, next links followed up to SourcePageLimit pages
+	and limit urls (the rest is dropped). Pages are bounded by UploadLimit.
+ */
+func sourceUrls(ctx context.Context, source string, limit int) ([]string, error) {
+	var urls []string
+	next := source
+	for page := 0; next != "" && len(urls) < limit; page++ {
+		if page >= SourcePageLimit {
+			return nil, fmt.Errorf("more than %d pages", SourcePageLimit)
+		}
+
+		current, err := url.Parse(next); if err != nil || (current.Scheme != "http" && current.Scheme != "https") {
+			return nil, fmt.Errorf("bad url %s", next)
+		}
+		data, err := fetchSourcePage(ctx, current.String()); if err != nil {
+			return nil, err
+		}
+
+		var list SourcePage
+		if err := json.Unmarshal(data, &list.Urls); err != nil {
+			if err := json.Unmarshal(data, &list); err != nil {
+				return nil, fmt.Errorf("not a url list")
+			}
+		}
+		urls = append(urls, list.Urls...)
+
+		next = ""
+		if list.Next != "" {
+			resolved, err := current.Parse(list.Next); if err != nil {
+				return nil, fmt.Errorf("bad next %s", list.Next)
+			}
+			next = resolved.String()
+		}
+	}
+
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls, nil
+}
+
+func fetchSourcePage(ctx context.Context, page string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, page, nil); if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := sourceClient.Do(req); if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body, configFrom(ctx))
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("code %d from %s", resp.StatusCode, redactUrl(page))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, UploadLimit + 1)); if err != nil {
+		return nil, err
+	}
+	if len(data) > UploadLimit {
+		return nil, fmt.Errorf("page over %d bytes", UploadLimit)
+	}
+	return data, nil
+}
+
+/**
+	Lists are fetched by the server itself, so addresses are checked when connecting
+	(after DNS and for every redirect): no loopback, private or link-local hosts.
+	No proxy either, the check would only see the proxy address.
+ */
+var sourceClient = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 2 * time.Second, ControlContext: publicOnly}).DialContext,
+	},
+}
+
+//Dial context carries the batch config (the page request context)
+func publicOnly(ctx context.Context, network string, address string, _ syscall.RawConn) error {
+	config := configFrom(ctx)
+	if config.SourcePrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address); if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("address %s not allowed", host)
+	}
+	return nil
+}
+
+/**
+	Global ceiling of running url checks (each one is a goroutine plus a connection),
+	per request limits alone don't bound many concurrent batches.
+ */
+type slots chan struct{}
+
+var checkSlots = newSlots(currentConfig().CheckLimit)
+
+var errBusy = errors.New("server busy, try again later")
+
+func newSlots(n int) slots {
+	if n <= 0 {
+		return nil
+	}
+	return make(slots, n)
+}
+
+//Backpressure: waits up to QueueTimeout for a slot
+func (s slots) acquire(ctx context.Context) error {
+	config := configFrom(ctx)
+	if s == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(config.QueueTimeout)
+	defer timer.Stop()
+	select {
+		case s <- struct{}{}:
+			return nil
+		case <-timer.C:
+			return errBusy
+		case <-ctx.Done():
+			return fmt.Errorf("cancelled by client")
+	}
+}
+
+func (s slots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+/**
+	Results written as a JSON array while they complete, flushed one by one:
+	"[", results separated by commas, "]" - a valid array once it's complete.
+	A failed write means the client is gone: the batch is canceled and nothing more is written.
+ */
+type arrayStream struct {
+	w       http.ResponseWriter
+	written []bool
+	n       int
+	cancel  context.CancelFunc
+	broken  bool
+}
+
+func newArrayStream(w http.ResponseWriter, urls int, cancel context.CancelFunc) *arrayStream {
+	w.Header().Set("Content-Type", "application/json")
+	s := &arrayStream{w: w, written: make([]bool, urls), cancel: cancel}
+	s.print("[")
+	return s
+}
+
+func (s *arrayStream) write(result UrlCheckResult) {
+	if s == nil {
+		return
+	}
+
+	item, err := json.Marshal(result); if err != nil {
+		fmt.Print("0")
+		return
+	}
+	if s.n > 0 {
+		s.print(",")
+	}
+	s.print(string(item))
+	s.written[result.Url.index] = true
+	s.n++
+}
+
+//Last element of a streamed array (StreamSummary)
+type StreamDone struct {
+	Done bool `json:"done"`
+	CheckResponse
+}
+
+//Last element of a stream that failed on our side, instead of the remaining urls and the summary
+type StreamError struct {
+	Error string `json:"error"`
+}
+
+func (s *arrayStream) fail(message string) {
+	if item, err := json.Marshal(StreamError{Error: message}); err == nil {
+		if s.n > 0 {
+			s.print(",")
+		}
+		s.print(string(item))
+	}
+	s.print("]")
+	fmt.Print("+")
+}
+
+//Urls never checked (batch cut short) are written last, then the summary
+func (s *arrayStream) close(results []UrlCheckResult, summary *StreamDone) {
+	for i, result := range results {
+		if !s.written[i] && result.Url != nil {
+			s.write(result)
+		}
+	}
+	if summary != nil {
+		if item, err := json.Marshal(summary); err == nil {
+			if s.n > 0 {
+				s.print(",")
+			}
+			s.print(string(item))
+		} else {
+			fmt.Print("0")
+		}
+	}
+	s.print("]")
+	fmt.Print("+")
+}
+
+func (s *arrayStream) print(text string) {
+	if s.broken {
+		return
+	}
+	_, err := fmt.Fprint(s.w, text); if err != nil {
+		fmt.Print("!")
+		s.broken = true
+		s.cancel()
+		return
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Counts running checks and keeps the max seen
+func trackInFlight(inFlight, maxInFlight *int32, delta int32) {
+	n := atomic.AddInt32(inFlight, delta)
+	for {
+		max := atomic.LoadInt32(maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(maxInFlight, max, n) {
+			return
+		}
+	}
+}
+
+/**
+	Batch time budget is shared by the urls not started yet: each gets its
+	share of the time left per round of LimitOutgoingConnections parallel checks.
+ */
+type timeBudget struct {
+	deadline   time.Time
+	left       atomic.Int32
+	minTimeout time.Duration
+}
+
+func newTimeBudget(seconds float64, urls int, minTimeout time.Duration) *timeBudget {
+	if seconds <= 0 {
+		return nil
+	}
+	b := &timeBudget{deadline: time.Now().Add(time.Duration(seconds * float64(time.Second))), minTimeout: minTimeout}
+	b.left.Store(int32(urls))
+	return b
+}
+
+//Url timeout for the next check, 0 when the full url timeout fits, and whether it was raised to MIN_TIMEOUT
+func (b *timeBudget) timeout(full time.Duration) (time.Duration, bool) {
+	if b == nil {
+		return 0, false
+	}
+
+	left := b.left.Add(-1) + 1
+	rounds := (left + LimitOutgoingConnections - 1) / LimitOutgoingConnections
+	share := time.Until(b.deadline) / time.Duration(rounds)
+	if share >= full {
+		return 0, false
+	}
+	if share < b.minTimeout {
+		return b.minTimeout, true
+	}
+	if share < time.Millisecond {
+		share = time.Millisecond
+	}
+	return share, false
+}
+
+//n of the urls in the request order and their indexes
+func sampleUrls(urls []string, n int, rnd *lockedRand) ([]string, []int) {
+	picked := rnd.Perm(len(urls))[:n]
+	sort.Ints(picked)
+
+	sample := make([]string, n)
+	for i, index := range picked {
+		sample[i] = urls[index]
+	}
+	return sample, picked
+}
+
+//Order urls are scheduled in
+func scheduleOrder(n int, shuffle bool) []int {
+	if shuffle {
+		return shuffleRand.Perm(n)
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+/**
+	Per host parallel limit, unless set by client, grows with host diversity of the batch:
+	all urls on one host are checked one at a time (be polite), all urls on
+	distinct hosts use the full LimitOutgoingConnections, linear in between.
+ */
+func hostLimits(paths []string, override int) (map[string]chan struct{}, int) {
+	counts := map[string]int{}
+	for _, path := range paths {
+		counts[urlHost(path)]++
+	}
+
+	perHost := override
+	if perHost <= 0 {
+		perHost = 1
+		if len(paths) > 1 {
+			perHost += (LimitOutgoingConnections - 1) * (len(counts) - 1) / (len(paths) - 1)
+		}
+	}
+	if perHost > LimitOutgoingConnections {
+		perHost = LimitOutgoingConnections
+	}
+
+	queues := map[string]chan struct{}{}
+	for host := range counts {
+		queues[host] = make(chan struct{}, perHost)
+	}
+	return queues, perHost
+}
+
+func countHosts(paths []string) int {
+	hosts := map[string]bool{}
+	for _, path := range paths {
+		hosts[urlHost(path)] = true
+	}
+	return len(hosts)
+}
+
+//Host of the url or the url itself when it doesn't parse
+func urlHost(path string) string {
+	u, err := url.Parse(path); if err != nil || u.Host == "" {
+		return path
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+/**
+	Chain mode: urls are checked sequentially with shared cookies,
+	the first failed step stops the chain.
+ */
+func checkChain(w http.ResponseWriter, r *http.Request, ctx context.Context, req CheckRequest) {
+	req.HostConcurrency = 1
+
+	jar, err := cookiejar.New(nil); if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts := req.CheckOptions
+	opts.jar = jar
+
+	var CheckResult []UrlCheckResult
+	resultChan := make(chan UrlCheckResult, 1)
+	pacer := newPacer(req.RequestsPerSecond)
+	spacing := newHostSpacing(req)
+	for index, path := range req.Urls {
+		//A wait cut by the batch deadline or the client ends the chain before the next step
+		waitErr := pace(ctx, pacer); if waitErr == nil {
+			waitErr = spacing.wait(ctx, urlHost(path))
+		}
+		if waitErr != nil || ctx.Err() != nil {
+			if batchExpired(ctx, r) {
+				writeCheckResponse(w, r, req, chainResponse(CheckResult, true))
+				return
+			}
+			batchFailed(w, ctx, fmt.Errorf("cancelled by client"))
+			return
+		}
+
+		if err := checkSlots.acquire(ctx); err != nil {
+			if err == errBusy {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			batchFailed(w, ctx, err)
+			return
+		}
+		err := CheckUrl(Url{path: path, index: index}, opts, resultChan, ctx)
+		checkSlots.release()
+		CheckResult = append(CheckResult, <-resultChan)
+		if err != nil {
+			if batchExpired(ctx, r) {
+				writeCheckResponse(w, r, req, chainResponse(CheckResult, true))
+				return
+			}
+			fmt.Print(".")
+			alertFailure(req.settings(), err, CheckResult)
+			batchFailed(w, ctx, err)
+			return
+		}
+	}
+
+	writeCheckResponse(w, r, req, chainResponse(CheckResult, false))
+}
+
+//Chain runs a single check at a time
+func chainResponse(results []UrlCheckResult, partial bool) CheckResponse {
+	var inFlight int32
+	if len(results) > 0 {
+		inFlight = 1
+	}
+	return CheckResponse{Urls: results, Partial: partial, Concurrency: 1, HostConcurrency: 1, MaxInFlight: inFlight}
+}
+
+//Groups follow the order their first result has (SortBy applies)
+func collapseResults(results []UrlCheckResult) []ResultGroup {
+	var groups []ResultGroup
+	for _, result := range results {
+		found := false
+		for i := range groups {
+			if groups[i].Code == result.Code && groups[i].Healthy == result.Healthy {
+				groups[i].Count++
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, ResultGroup{Code: result.Code, Healthy: result.Healthy, Count: 1, Sample: result})
+		}
+	}
+	return groups
+}
+
+func countTrue(flags ...bool) int {
+	n := 0
+	for _, flag := range flags {
+		if flag {
+			n++
+		}
+	}
+	return n
+}
+
+func firstDuplicate(paths []string) string {
+	seen := map[string]bool{}
+	for _, path := range paths {
+		if seen[path] {
+			return path
+		}
+		seen[path] = true
+	}
+	return ""
+}
+
+func groupByHost(results []UrlCheckResult) map[string]*HostGroup {
+	hosts := map[string]*HostGroup{}
+	times := map[string][]float64{}
+	for _, result := range results {
+		if result.Url == nil {
+			continue
+		}
+		host := urlHost(result.Url.path)
+		group, ok := hosts[host]
+		if !ok {
+			group = &HostGroup{}
+			hosts[host] = group
+		}
+		group.Urls = append(group.Urls, result)
+		if result.Healthy {
+			group.Healthy++
+		} else {
+			group.Unhealthy++
+		}
+		if result.Code > 0 {
+			times[host] = append(times[host], result.Time)
+		}
+	}
+
+	for host, hostTimes := range times {
+		hosts[host].Latency = latencyStats(hostTimes)
+	}
+	return hosts
+}
+
+//Different urls with the same content
+func duplicateBodies(results []UrlCheckResult) map[string][]string {
+	urls := map[string][]string{}
+	for _, result := range results {
+		if result.BodyHash != "" {
+			urls[result.BodyHash] = append(urls[result.BodyHash], result.Url.path)
+		}
+	}
+
+	var duplicates map[string][]string
+	for hash, paths := range urls {
+		if len(paths) > 1 {
+			if duplicates == nil {
+				duplicates = map[string][]string{}
+			}
+			duplicates[hash] = paths
+		}
+	}
+	return duplicates
+}
+
+//Urls missing from the baseline and urls not checked (batch cut short) are not flagged
+func markChanged(results []UrlCheckResult, baseline map[string]int) []UrlCheckResult {
+	marked := append([]UrlCheckResult(nil), results...)
+	for i, result := range marked {
+		if expected, ok := baseline[result.Url.path]; ok && result.Code > 0 {
+			marked[i].Changed = result.Code != expected
+		}
+	}
+	return marked
+}
+
+/**
+	SortBy orders: slowest first, failing first (then higher codes)
+	or alphabetical by url. Ties keep the request order.
+ */
+var resultSorters = map[string]func(a, b UrlCheckResult) bool{
+	"latency_desc": func(a, b UrlCheckResult) bool {
+		return a.Time > b.Time
+	},
+	"status": func(a, b UrlCheckResult) bool {
+		if a.Healthy != b.Healthy {
+			return !a.Healthy
+		}
+		return a.Code > b.Code
+	},
+	"url": func(a, b UrlCheckResult) bool {
+		return a.Url.path < b.Url.path
+	},
+}
+
+/**
+	Batch passes when all_healthy: every url is healthy (unchecked ones are not),
+	error_budget: unhealthy urls fit ErrorBudget/ErrorBudgetPercent.
+ */
+var verdictRules = map[string]func(req CheckRequest, results []UrlCheckResult) bool{
+	"all_healthy": func(req CheckRequest, results []UrlCheckResult) bool {
+		for _, result := range results {
+			if !result.Healthy {
+				return false
+			}
+		}
+		return true
+	},
+	"error_budget": func(req CheckRequest, results []UrlCheckResult) bool {
+		return !req.overBudget(results)
+	},
+}
+
+/**
+	Echoed request hides url passwords and query values
+	of secret looking keys (token, key, secret, password, auth),
+	in urls and Baseline keys alike. A request Body is hidden whole.
+ */
+func redactRequest(req CheckRequest) CheckRequest {
+	urls := make([]string, len(req.Urls))
+	for i, path := range req.Urls {
+		urls[i] = redactUrl(path)
+	}
+	req.Urls = urls
+	if req.UrlsSource != "" {
+		req.UrlsSource = redactUrl(req.UrlsSource)
+	}
+
+	if req.QueryParams != nil {
+		params := map[string]string{}
+		for k, v := range req.QueryParams {
+			if secretName(k) {
+				v = "REDACTED"
+			}
+			params[k] = v
+		}
+		req.QueryParams = params
+	}
+
+	if req.Baseline != nil {
+		baseline := map[string]int{}
+		for path, code := range req.Baseline {
+			baseline[redactUrl(path)] = code
+		}
+		req.Baseline = baseline
+	}
+
+	//Request bodies often carry tokens, whatever the format
+	if req.Body != "" {
+		req.Body = "REDACTED"
+	}
+
+	return req
+}
+
+func redactUrl(path string) string {
+	u, err := url.Parse(path); if err != nil {
+		return path
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+
+	query := u.Query()
+	redacted := false
+	for k := range query {
+		if secretName(k) {
+			query.Set(k, "REDACTED")
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+func secretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"token", "key", "secret", "password", "auth"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+	One url can't dominate the response (huge trailers, body lines or hook
+	annotations): a result over maxBytes loses them, then its message is cut.
+ */
+func limitResults(results []UrlCheckResult, maxBytes int) []UrlCheckResult {
+	var limited []UrlCheckResult
+	for i, result := range results {
+		body, err := json.Marshal(result)
+		if err != nil || len(body) <= maxBytes {
+			continue
+		}
+
+		if limited == nil {
+			limited = append([]UrlCheckResult(nil), results...)
+		}
+		result.Trailers = nil
+		result.Annotations = nil
+		result.BodyLines = nil
+		result.Truncated = true
+		if body, err = json.Marshal(result); err == nil && len(body) > maxBytes {
+			over := len(body) - maxBytes
+			if over < len(result.Message) {
+				result.Message = result.Message[:len(result.Message)-over]
+			} else {
+				result.Message = ""
+			}
+		}
+		limited[i] = result
+	}
+
+	if limited == nil {
+		return results
+	}
+	return limited
+}
+
+/**
+	Response over maxBytes drops results until it fits, failures are kept first.
+	Layout runs on the kept results, so groups, hosts and by_url shrink too.
+ */
+func marshalLimited(response CheckResponse, maxBytes int, layout func(CheckResponse) CheckResponse) ([]byte, error) {
+	body, err := json.Marshal(layout(response))
+	if err != nil || maxBytes <= 0 || len(body) <= maxBytes {
+		return body, err
+	}
+
+	var results []UrlCheckResult
+	for _, healthy := range []bool{false, true} {
+		for _, result := range response.Urls {
+			if result.Healthy == healthy {
+				results = append(results, result)
+			}
+		}
+	}
+
+	response.Truncated = true
+	for n := len(results) - 1; n >= 0; n-- {
+		response.Urls = results[:n]
+		body, err = json.Marshal(layout(response))
+		if err != nil || len(body) <= maxBytes {
+			break
+		}
+	}
+	return body, err
+}
+
+//Collapse, GroupByHost or MapByUrl replace the url list
+func layoutResults(req CheckRequest, response CheckResponse) CheckResponse {
+	if req.Collapse {
+		response.Groups = collapseResults(response.Urls)
+		response.Urls = nil
+	}
+
+	if req.GroupByHost {
+		response.Hosts = groupByHost(response.Urls)
+		response.Urls = nil
+	}
+
+	if req.MapByUrl {
+		response.ByUrl = map[string]UrlCheckResult{}
+		for _, result := range response.Urls {
+			if result.Url != nil {
+				response.ByUrl[result.Url.path] = result
+			}
+		}
+		response.Urls = nil
+	}
+	return response
+}
+
+//Accept: text/plain; version=0.0.4
+func acceptsPrometheus(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && strings.Contains(accept, "version=0.0.4")
+}
+
+/**
+	Batch as Prometheus text exposition, so it can be pushed/scraped as is.
+	The input index is a label too: an url listed twice would be a duplicate
+	series, and Prometheus rejects the whole scrape for one.
+ */
+func prometheusText(response CheckResponse) string {
+	var b strings.Builder
+	metrics := []struct {
+		name, help string
+		value      func(UrlCheckResult) float64
+	}{
+		{"url_check_up", "Whether the url check was healthy.", func(r UrlCheckResult) float64 {
+			if r.Healthy {
+				return 1
+			}
+			return 0
+		}},
+		{"url_check_status_code", "Response status code (10 when no response).", func(r UrlCheckResult) float64 {
+			return float64(r.Code)
+		}},
+		{"url_check_duration_seconds", "Time of the url check.", func(r UrlCheckResult) float64 {
+			return r.Time
+		}},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+		for _, result := range response.Urls {
+			fmt.Fprintf(&b, "%s{url=\"%s\",index=\"%d\"} %s\n", m.name, prometheusLabel(result.Url.path), result.Index, strconv.FormatFloat(m.value(result), 'g', -1, 64))
+		}
+	}
+	return b.String()
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabel(v string) string {
+	return prometheusLabelEscaper.Replace(v)
+}
+
+func acceptsJUnit(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/vnd.junit+xml") || r.URL.Query().Get("format") == "junit"
+}
+
+type JUnitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []JUnitCase `xml:"testcase"`
+}
+
+type JUnitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *JUnitFailure `xml:"failure,omitempty"`
+}
+
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+}
+
+/**
+	Batch as a JUnit report for CI, a testcase per url failing when unhealthy.
+ */
+func junitXML(response CheckResponse) ([]byte, error) {
+	suite := JUnitSuite{Name: "url-check", Tests: len(response.Urls)}
+	for _, result := range response.Urls {
+		testcase := JUnitCase{Name: result.Url.path, ClassName: "url-check", Time: result.Time}
+		if !result.Healthy {
+			suite.Failures++
+			testcase.Failure = &JUnitFailure{Message: result.Message, Type: result.ErrorKind}
+		}
+		suite.Time += result.Time
+		suite.Cases = append(suite.Cases, testcase)
+	}
+
+	b, err := xml.MarshalIndent(suite, "", "  "); if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+/**
+	X-Deadline header bounds the whole batch,
+	either RFC3339 time or seconds from the request start ("2.5").
+	The write timeout bounds it too: the batch ends at 90% of it, so small
+	concurrency with many slow urls still gets its partial results written.
+	Both count from started, when the handler got the request.
+ */
+func batchContext(r *http.Request, started time.Time) (context.Context, context.CancelFunc, error) {
+	config := configFrom(r.Context())
+	var deadline time.Time
+	if config.WriteTimeout > 0 {
+		deadline = started.Add(config.WriteTimeout - config.WriteTimeout/10)
+	}
+
+	if v := r.Header.Get("X-Deadline"); v != "" {
+		requested, err := time.Parse(time.RFC3339, v); if err != nil {
+			secs, err := strconv.ParseFloat(v, 64); if err != nil || secs <= 0 {
+				return nil, nil, fmt.Errorf("bad X-Deadline: %s", v)
+			}
+			requested = started.Add(time.Duration(secs * float64(time.Second)))
+		}
+		if deadline.IsZero() || requested.Before(deadline) {
+			deadline = requested
+		}
+	}
+
+	if deadline.IsZero() {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return ctx, cancel, nil
+}
+
+//One token at a time, so checks start 1/rps apart from the first one
+func newPacer(rps float64) *rate.Limiter {
+	if rps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rps), 1)
+}
+
+/**
+	Waits for the next start, not limiter.Wait: that fails at once when the batch
+	deadline comes before the token, these urls should end as batch_timeout instead.
+ */
+func pace(ctx context.Context, pacer *rate.Limiter) error {
+	if pacer == nil {
+		return nil
+	}
+
+	reservation := pacer.Reserve()
+	timer := time.NewTimer(reservation.Delay())
+	defer timer.Stop()
+	select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			reservation.Cancel()
+			return ctx.Err()
+	}
+}
+
+/**
+	Built like checkUrl does from the redacted request, so url passwords and secret
+	query values (and the Basic auth made of them) don't show. Transport-added headers
+	(User-Agent, Accept-Encoding) are included, redirects and compare variants are not.
+ */
+func writePreview(w http.ResponseWriter, ctx context.Context, req CheckRequest) {
+	redacted := redactRequest(req)
+	preview := PreviewResponse{Requests: make([]PreviewedRequest, len(redacted.Urls))}
+	for index, path := range redacted.Urls {
+		path, _, _ = punycodeUrl(path)
+		path = withQueryParams(path, redacted.QueryParams)
+		previewed := PreviewedRequest{Index: index, Url: path}
+
+		outbound, err := newCheckRequest(ctx, path, redacted.CheckOptions.pickUserAgent())
+		if err == nil {
+			//http.Client adds it from the url user, the dump doesn't
+			if user := outbound.URL.User; user != nil && outbound.Header.Get("Authorization") == "" {
+				password, _ := user.Password()
+				outbound.SetBasicAuth(user.Username(), password)
+			}
+			previewed.Method = outbound.Method
+			var dump []byte
+			dump, err = httputil.DumpRequestOut(outbound, false)
+			previewed.Request = string(dump)
+		}
+		if err != nil {
+			previewed.Error = err.Error()
+		}
+		preview.Requests[index] = previewed
+	}
+
+	fooMarshalled, err := json.Marshal(preview); if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = fmt.Fprint(w, string(fooMarshalled)); if err != nil {
+		fmt.Print("!")
+	}
+}
+
+/**
+	Fixed spacing of check starts per host (HostDelayMs, HostDelays) for APIs with
+	a documented rate. Starts are reserved in turn, parallel checks of a host are spaced too.
+	Retries and samples of a url are not.
+ */
+type hostSpacing struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	delays   map[string]time.Duration
+	reserved map[string]time.Time
+}
+
+func newHostSpacing(req CheckRequest) *hostSpacing {
+	if req.HostDelayMs <= 0 && len(req.HostDelays) == 0 {
+		return nil
+	}
+	s := &hostSpacing{
+		delay: time.Duration(req.HostDelayMs) * time.Millisecond,
+		delays: map[string]time.Duration{},
+		reserved: map[string]time.Time{}}
+	for host, ms := range req.HostDelays {
+		s.delays[strings.ToLower(host)] = time.Duration(ms) * time.Millisecond
+	}
+	return s
+}
+
+func minValue(values map[string]int) int {
+	min := 0
+	for _, value := range values {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
+
+func (s *hostSpacing) wait(ctx context.Context, host string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	delay, ok := s.delays[host]
+	if !ok {
+		delay = s.delay
+	}
+	start := time.Now()
+	if next, ok := s.reserved[host]; ok && next.After(start) {
+		start = next
+	}
+	s.reserved[host] = start.Add(delay)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(start))
+	defer timer.Stop()
+	select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+}
+
+/**
+	Cause of a stopped batch from the context cause: the request context canceled (client gone),
+	the batch deadline, or the first url error the group canceled with. A chain stops on its
+	first error without canceling, that's fail_fast too.
+ */
+func stopCause(ctx context.Context) string {
+	cause := context.Cause(ctx)
+	switch {
+		case errors.Is(cause, context.DeadlineExceeded):
+			return CauseBatchTimeout
+		case cause == context.Canceled:
+			return CauseClientDisconnect
+	}
+	return CauseFailFast
+}
+
+func batchFailed(w http.ResponseWriter, ctx context.Context, err error) {
+	http.Error(w, "{'error' : '" + err.Error() + "', 'cause' : '" + stopCause(ctx) + "'}", http.StatusBadRequest)
+}
+
+//Batch deadline passed while client still waits, so partial results are returned
+func batchExpired(ctx context.Context, r *http.Request) bool {
+	return ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil
+}
+
+//Per url limits, baseline and order, the same for every response format
+func prepareResponse(req CheckRequest, response CheckResponse) CheckResponse {
+	config := req.settings()
+	response.Sampled = req.sampled
+	if response.Partial {
+		response.Cause = CauseBatchTimeout
+	}
+	//Before results are dropped, the verdict is about the whole batch
+	if rule, ok := verdictRules[req.Verdict]; ok {
+		response.Verdict = "fail"
+		if rule(req, response.Urls) {
+			response.Verdict = "pass"
+		}
+	}
+
+	if config.ResultLimit > 0 {
+		response.Urls = limitResults(response.Urls, config.ResultLimit)
+	}
+
+	if req.Baseline != nil {
+		response.Urls = markChanged(response.Urls, req.Baseline)
+	}
+
+	if req.HashBody {
+		response.Duplicates = duplicateBodies(response.Urls)
+	}
+
+	if sorter, ok := resultSorters[req.SortBy]; ok {
+		results := append([]UrlCheckResult(nil), response.Urls...)
+		sort.SliceStable(results, func(i, j int) bool {
+			return sorter(results[i], results[j])
+		})
+		response.Urls = results
+	}
+
+	return response
+}
+
+func writeCheckResponse(w http.ResponseWriter, r *http.Request, req CheckRequest, response CheckResponse) {
+	fmt.Print("+")
+
+	response = prepareResponse(req, response)
+
+	if req.etagKey != "" && !response.Partial {
+		etag := responseETag(req.etagKey, response)
+		etags.store(req.etagKey, etag, req.settings().ETagTTL)
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if acceptsPrometheus(r) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeStatus(w, response)
+		_, err := fmt.Fprint(w, prometheusText(response)); if err != nil {
+			fmt.Print("!")
+		}
+		return
+	}
+
+	if acceptsJUnit(r) {
+		report, err := junitXML(response); if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.junit+xml")
+		writeStatus(w, response)
+		_, err = w.Write(report); if err != nil {
+			fmt.Print("!")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if req.EchoRequest {
+		echo := redactRequest(req)
+		response.Request = &echo
+	}
+
+	if req.ReportOptions {
+		response.EffectiveOptions = effectiveOptions(req, response)
+	}
+
+	if req.Archive {
+		response.ArchiveKey = archiveKey(time.Now())
+	}
+
+	//Unencodable values (f.e. hook annotations) are a server fault, not an empty result
+	fooMarshalled, err := marshalLimited(response, req.MaxResponseBytes, func(response CheckResponse) CheckResponse {
+		return layoutResults(req, response)
+	}); if err != nil {
+		fmt.Printf("Response error: %v\n", err)
+		http.Error(w, "{'error' : 'internal error: response not encodable'}", http.StatusInternalServerError)
+		return
+	}
+
+	if req.Archive {
+		go archive(req.settings(), response.ArchiveKey, fooMarshalled)
+	}
+
+	writeStatus(w, response)
+	_, err = fmt.Fprint(w, string(fooMarshalled)); if err != nil {
+		fmt.Print("!")
+	}
+}
+
+//424 lets a plain curl --fail catch a batch over its error budget
+func writeStatus(w http.ResponseWriter, response CheckResponse) {
+	if response.OverBudget {
+		w.WriteHeader(http.StatusFailedDependency)
+	}
+}
+
+/**
+	ETags of recent batches by request. Within ETAG_TTL a request whose If-None-Match
+	has its last ETag gets 304 without any check. Later it's checked again and still
+	gets 304 when the results didn't change.
+ */
+type etagCache struct {
+	mu      sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	etag    string
+	expires time.Time
+}
+
+var etags = &etagCache{entries: map[string]etagEntry{}}
+
+//ETag of the last run when it's still fresh and matches If-None-Match
+func (c *etagCache) fresh(key string, ifNoneMatch string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry.etag, ok && time.Now().Before(entry.expires) && etagMatches(ifNoneMatch, entry.etag)
+}
+
+func (c *etagCache) store(key string, etag string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= ETagCacheSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) < ETagCacheSize {
+		c.entries[key] = etagEntry{etag: etag, expires: now.Add(ttl)}
+	}
+}
+
+//Body format comes from Accept and ?format too
+func etagKey(r *http.Request, req CheckRequest) string {
+	fooMarshalled, err := json.Marshal(req); if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(r.Header.Get("Accept") + "\n" + r.URL.RawQuery + "\n" + string(fooMarshalled)))
+	return hex.EncodeToString(sum[:])
+}
+
+//Over what stays the same between runs: url, code, health and error kind (not times)
+func responseETag(key string, response CheckResponse) string {
+	h := sha256.New()
+	h.Write([]byte(key))
+	for _, result := range response.Urls {
+		path := ""
+		if result.Url != nil {
+			path = result.Url.path
+		}
+		fmt.Fprintf(h, "\n%s %d %t %s", path, result.Code, result.Healthy, result.ErrorKind)
+	}
+	fmt.Fprintf(h, "\n%t %s", response.OverBudget, response.Verdict)
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+//Comma separated list, weak validators compare the same, * matches any
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+	Failure alerts to a chat webhook.
+	The same set of failed urls is alerted once per AlertDedup,
+	and all alerts together are limited to AlertsPerMinute.
+ */
+type alerter struct {
+	mu      sync.Mutex
+	sent    map[string]time.Time
+	limiter *rate.Limiter
+}
+
+var alerts = &alerter{
+	sent:    map[string]time.Time{},
+	limiter: rate.NewLimiter(rate.Every(time.Minute/AlertsPerMinute), 1),
+}
+
+func alertFailure(config *Config, batchErr error, results []UrlCheckResult) {
+	if config.AlertWebhook == "" {
+		return
+	}
+
+	var failed []string
+	lines := []string{fmt.Sprintf("url check failed: %s", batchErr)}
+	for _, result := range results {
+		if result.Healthy || result.Code == 0 {
+			continue
+		}
+		failed = append(failed, result.Url.path)
+		lines = append(lines, fmt.Sprintf("- %s", result.Message))
+	}
+
+	if !alerts.allow(strings.Join(failed, " "), config.AlertDedup) {
+		return
+	}
+
+	go postAlert(config, strings.Join(lines, "\n"))
+}
+
+func (a *alerter) allow(key string, dedup time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, at := range a.sent {
+		if now.Sub(at) > dedup {
+			delete(a.sent, k)
+		}
+	}
+
+	if _, ok := a.sent[key]; ok || !a.limiter.Allow() {
+		return false
+	}
+	a.sent[key] = now
+	return true
+}
+
+//Slack wants {"text"}, Discord wants {"content"}
+func postAlert(config *Config, text string) {
+	payload := map[string]string{"text": text}
+	if config.AlertFormat == "discord" {
+		payload = map[string]string{"content": text}
+	}
+
+	body, err := json.Marshal(payload); if err != nil {
+		fmt.Printf("Alert error: %v\n", err)
+		return
+	}
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(config.AlertWebhook, "application/json", bytes.NewReader(body)); if err != nil {
+		fmt.Printf("Alert error: %v\n", err)
+		return
+	}
+	defer closeBody(resp.Body, config)
+
+	if resp.StatusCode >= 300 {
+		fmt.Printf("Alert error: webhook code %d\n", resp.StatusCode)
+	}
+}
+
+//checks/2006/01/02/<nanos>-<random>.json
+func archiveKey(now time.Time) string {
+	return fmt.Sprintf("checks/%s/%d-%06d.json", now.UTC().Format("2006/01/02"), now.UnixNano(), int(jitterRand.Float64()*1e6))
+}
+
+//Upload with retries, failures are only logged (the client already has its response)
+func archive(config *Config, key string, body []byte) {
+	var err error
+	for attempt := 0; attempt <= RetryLimit; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay(attempt-1, "none"))
+		}
+		if err = putObject(config, key, body); err == nil {
+			return
+		}
+	}
+	fmt.Printf("Archive error: %s: %v\n", key, err)
+}
+
+/**
+	PUT to S3 (or MinIO, R2...) signed with AWS signature v4,
+	path style: endpoint/bucket/key.
+ */
+func putObject(config *Config, key string, body []byte) error {
+	endpoint := strings.TrimSuffix(config.S3Endpoint, "/") + "/" + config.S3Bucket + "/" + key
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body)); if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(config, req, body, time.Now().UTC())
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req); if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body, config)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("bucket code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signV4(config *Config, req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + config.S3Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := []byte("AWS4" + config.S3SecretKey)
+	for _, part := range []string{date, config.S3Region, "s3", "aws4_request"} {
+		signingKey = hmacSha256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.S3AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/**
+	Always-on monitor: scheduled urls are re-checked every interval
+	(plus up to 10% jitter) and the latest result of each is kept for /status.
+ */
+type scheduler struct {
+	mu     sync.RWMutex
+	latest map[string]ScheduledResult
+}
+
+//Latest result of a scheduled url
+type ScheduledResult struct {
+	UrlCheckResult
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+//Scheduled checks for /status
+type StatusResponse struct {
+	Urls []ScheduledResult `json:"urls"`
+}
+
+var schedule = &scheduler{latest: map[string]ScheduledResult{}}
+
+func (s *scheduler) run(ctx context.Context, paths []string, interval time.Duration) {
+	for {
+		s.checkAll(ctx, paths)
+
+		delay := interval + time.Duration(jitterRand.Float64()*float64(interval)/10)
+		select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+		}
+	}
+}
+
+/**
+	HEAD to every warm url through the shared transport, in parallel. The connection
+	stays idle in the pool (DNS cache filled too), failures are only logged.
+ */
+func warmUp(ctx context.Context, paths []string) {
+	gr := sync.WaitGroup{}
+	for _, path := range paths {
+		gr.Add(1)
+		go func(path string) {
+			defer gr.Done()
+
+			warmCtx, cancel := context.WithTimeout(ctx, UrlTimeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(warmCtx, http.MethodHead, path, nil); if err != nil {
+				fmt.Printf("Warm up error: %v\n", err)
+				return
+			}
+			resp, err := transport.RoundTrip(req); if err != nil {
+				fmt.Printf("Warm up error: %v\n", err)
+				return
+			}
+			closeBody(resp.Body, configFrom(ctx))
+		}(path)
+	}
+	gr.Wait()
+}
+
+func (s *scheduler) checkAll(ctx context.Context, paths []string) {
+	limitQueue := make(chan struct{}, LimitOutgoingConnections)
+	gr := sync.WaitGroup{}
+
+	for index, path := range paths {
+		limitQueue <- struct{}{}
+		gr.Add(1)
+		go func(url Url) {
+			defer gr.Done()
+			defer func() { <-limitQueue }()
+
+			//Busy server: the url keeps its last result until the next round
+			if err := checkSlots.acquire(ctx); err != nil {
+				return
+			}
+			defer checkSlots.release()
+
+			resultChan := make(chan UrlCheckResult, 1)
+			_ = CheckUrl(url, CheckOptions{}, resultChan, ctx)
+			result := <-resultChan
+			if ctx.Err() != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.latest[url.path] = ScheduledResult{UrlCheckResult: result, CheckedAt: time.Now()}
+			s.mu.Unlock()
+		}(Url{path: path, index: index})
+	}
+
+	gr.Wait()
+}
+
+func (s *scheduler) status() StatusResponse {
+	config := currentConfig()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	response := StatusResponse{Urls: []ScheduledResult{}}
+	for _, path := range config.ScheduleUrls {
+		if result, ok := s.latest[path]; ok {
+			response.Urls = append(response.Urls, result)
+		}
+	}
+	return response
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(schedule.status())
+}
+
+//Self-test result
+type BenchmarkResponse struct {
+	Checks    int     `json:"checks"`
+	Errors    int     `json:"errors"`
+	Seconds   float64 `json:"seconds"`
+	PerSecond float64 `json:"per_second"`
+}
+
+/**
+	Debug only: checks a local server n times (?n=100) with the usual
+	outgoing parallel limit and reports the throughput.
+ */
+func benchmarkHandler(w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 && v <= 10000 {
+		n = v
+	}
+
+	//Local target on a random port, closing the listener stops it
+	ln, err := net.Listen("tcp", "127.0.0.1:0"); if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer ln.Close()
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, "ok")
+		}))
+	}()
+	target := "http://" + ln.Addr().String()
+
+	resultChan := make(chan UrlCheckResult, n)
+	limitQueue := make(chan struct{}, LimitOutgoingConnections)
+	gr := sync.WaitGroup{}
+	failed := 0
+	mu := sync.Mutex{}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		limitQueue <- struct{}{}
+		gr.Add(1)
+		go func() {
+			defer gr.Done()
+			defer func() { <-limitQueue }()
+			fail := func() {
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+
+			//Same global ceiling as the batches it competes with
+			if err := checkSlots.acquire(r.Context()); err != nil {
+				fail()
+				return
+			}
+			defer checkSlots.release()
+			if err := CheckUrl(Url{path: target}, CheckOptions{}, resultChan, r.Context()); err != nil {
+				fail()
+			}
+			<-resultChan
+		}()
+	}
+	gr.Wait()
+	secs := time.Since(start).Seconds()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(BenchmarkResponse{
+		Checks:    n,
+		Errors:    failed,
+		Seconds:   secs,
+		PerSecond: float64(n) / secs,
+	})
+}
+
+/**
+	Outgoing connections.
+	All checks share one transport (keep-alive pool), connections are
+	opened by dialer below.
+ */
+var transport = newTransport()
+
+//Shared transport going through each region proxy
+var regionTransports = newRegionTransports()
+
+func newRegionTransports() map[string]*http.Transport {
+	config := currentConfig()
+	transports := map[string]*http.Transport{}
+	for region, proxy := range config.RegionProxies {
+		t := transport.Clone()
+		t.Proxy = http.ProxyURL(proxy)
+		transports[region] = t
+	}
+	return transports
+}
+
+func newTransport() *http.Transport {
+	config := currentConfig()
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = newDialer().DialContext
+	//The transport keys connections by scheme and host:port, dialing, in use and idle all count
+	t.MaxConnsPerHost = config.PortConnLimit
+	//Only requests with Expect: 100-continue wait, the default second is the whole UrlTimeout
+	t.ExpectContinueTimeout = ExpectContinueWait
+	return t
+}
+
+//Metrics at /debug/vars
+var (
+	dialsActive = expvar.NewMap("dials_active")
+	dialsTotal  = expvar.NewMap("dials_total")
+	//Most connections open at once per host:port, for the first PortStatsSize ports
+	connsMaxPerPort = expvar.NewMap("conns_max_per_port")
+)
+
+var portConns = &connCounter{open: map[string]int{}, max: map[string]int{}}
+
+//Open connections per dialed host:port (the proxy with region proxies)
+type connCounter struct {
+	mu   sync.Mutex
+	open map[string]int
+	max  map[string]int
+}
+
+func (c *connCounter) track(addr string, conn net.Conn) net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open[addr]++
+	if _, ok := c.max[addr]; ok || len(c.max) < PortStatsSize {
+		if c.open[addr] > c.max[addr] {
+			c.max[addr] = c.open[addr]
+			connsMaxPerPort.Add(addr, 1)
+		}
+	}
+	return &countedConn{Conn: conn, release: func() { c.release(addr) }}
+}
+
+func (c *connCounter) release(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open[addr]--
+	if c.open[addr] <= 0 {
+		delete(c.open, addr)
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+/**
+	Dialer resolves the host itself to know the ip family and bounds concurrent
+	connection attempts per family, so slow ipv6 doesn't starve ipv4 and back.
+	Established connections don't hold the slot, idle keep-alive ones would block forever.
+ */
+type dialer struct {
+	dialer   *net.Dialer
+	resolver resolver
+	v4       chan struct{}
+	v6       chan struct{}
+	//Unix nanos until which new dials wait, set on EMFILE
+	fdPause  atomic.Int64
+}
+
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newDialer() *dialer {
+	config := currentConfig()
+	d := &dialer{
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: config.TCPKeepAlive},
+		resolver: net.DefaultResolver,
+	}
+	if config.DNSCacheTTL > 0 {
+		d.resolver = newCachingResolver(net.DefaultResolver, config.DNSCacheTTL)
+	}
+	if config.DialLimitV4 > 0 {
+		d.v4 = make(chan struct{}, config.DialLimitV4)
+	}
+	if config.DialLimitV6 > 0 {
+		d.v6 = make(chan struct{}, config.DialLimitV6)
+	}
+	return d
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr); if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookup(ctx, host); if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("no addresses for %s", host)
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.dialIp(ctx, network, ip.IP, port)
+		if err == nil {
+			return portConns.track(addr, conn), nil
+		}
+	}
+	return nil, err
+}
+
+//Slow dns is reported as such instead of eating the whole url timeout
+func (d *dialer) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	config := configFrom(ctx)
+	if config.DNSTimeout <= 0 {
+		return d.resolver.LookupIPAddr(ctx, host)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, config.DNSTimeout)
+	defer cancel()
+
+	ips, err := d.resolver.LookupIPAddr(lookupCtx, host)
+	if err != nil && lookupCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return nil, &dnsTimeoutError{host: host}
+	}
+	return ips, err
+}
+
+/**
+	In-process dns cache, batches with many urls of one host resolve it once.
+	Ttl is fixed (the system resolver doesn't tell record ttls), failures are not cached.
+ */
+type cachingResolver struct {
+	resolver resolver
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	ips     []net.IPAddr
+	expires time.Time
+}
+
+//Set in the check context, marks the dial of the check used a cached lookup
+type dnsCacheHitKey struct{}
+
+func newCachingResolver(r resolver, ttl time.Duration) *cachingResolver {
+	return &cachingResolver{resolver: r, ttl: ttl, entries: map[string]dnsEntry{}}
+}
+
+func (c *cachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		if hit, ok := ctx.Value(dnsCacheHitKey{}).(*atomic.Bool); ok {
+			hit.Store(true)
+		}
+		return entry.ips, nil
+	}
+
+	ips, err := c.resolver.LookupIPAddr(ctx, host); if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= DNSCacheSize {
+		for cached, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, cached)
+			}
+		}
+	}
+	if len(c.entries) < DNSCacheSize {
+		c.entries[host] = dnsEntry{ips: ips, expires: now.Add(c.ttl)}
+	}
+	return ips, nil
+}
+
+type dnsTimeoutError struct {
+	host string
+}
+
+func (e *dnsTimeoutError) Error() string {
+	return "dns timeout for " + e.host
+}
+
+func (e *dnsTimeoutError) Timeout() bool {
+	return true
+}
+
+func (d *dialer) dialIp(ctx context.Context, network string, ip net.IP, port string) (net.Conn, error) {
+	config := configFrom(ctx)
+	family, sem := "ipv4", d.v4
+	if ip.To4() == nil {
+		family, sem = "ipv6", d.v6
+	}
+
+	if sem != nil {
+		select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return nil, ctx.Err()
+		}
+	}
+
+	if err := d.waitFds(ctx); err != nil {
+		return nil, err
+	}
+
+	dialsTotal.Add(family, 1)
+	dialsActive.Add(family, 1)
+	defer dialsActive.Add(family, -1)
+
+	conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	//Only the connect is repeated, cheaper than retrying the whole request
+	for retry := 0; err != nil && retry < config.DialRetries && ctx.Err() == nil; retry++ {
+		if tooManyFiles(err) {
+			break
+		}
+
+		select {
+			case <-time.After(DialRetryDelay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+		}
+		dialsTotal.Add(family, 1)
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	}
+	if err != nil && tooManyFiles(err) && config.FdBackoff > 0 {
+		d.fdPause.Store(time.Now().Add(config.FdBackoff).UnixNano())
+	}
+	return conn, err
+}
+
+//Out of file descriptors every dial fails right away, give closing connections a moment
+func (d *dialer) waitFds(ctx context.Context) error {
+	wait := time.Until(time.Unix(0, d.fdPause.Load()))
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+}
+
+func tooManyFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		strings.Contains(err.Error(), "too many open files")
+}
+
+/**
+	Result hook runs on every completed url check before it goes to the response.
+	It can enrich or redact the result, or veto it by returning an error
+	(the url becomes unhealthy, so the batch fails). Err is the check error so far.
+ */
+type ResultHook func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error)
+
+//Registry of result hooks, run in the order they were added
+type Checker struct {
+	mu    sync.RWMutex
+	hooks []ResultHook
+}
+
+var checker = &Checker{}
+
+func (c *Checker) Use(hook ResultHook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, hook)
+}
+
+func (c *Checker) apply(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, hook := range c.hooks {
+		result, err = hook(url, result, err)
+	}
+	return result, err
+}
+
+func CheckUrl(url Url, opts CheckOptions, ch chan <- UrlCheckResult, ctx context.Context) error {
+	opts = opts.pickUserAgent()
+	if opts.trace != "" {
+		opts.traceParent = newTraceParent(opts.trace)
+	}
+	started := time.Now()
+	result, err := safeCheck(url, opts, ctx)
+	if opts.ReportTimestamps {
+		result.StartedAt = started.UTC().Format(time.RFC3339Nano)
+		result.FinishedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	result.UserAgent = opts.userAgent
+	result.TraceParent = opts.traceParent
+	result.TimeoutClamped = opts.timeoutClamped
+	result.Healthy = err == nil
+	result.Degraded = result.Healthy && result.degraded
+	result.Index = url.index
+	result.QueueWait = opts.queueWait.Seconds()
+	outbound.record(result)
+	ch <- result
+
+	return err
+}
+
+/**
+	A panic in a check (or in a result hook) fails only its own url,
+	with the stack logged, instead of taking the whole server down.
+ */
+func safeCheck(url Url, opts CheckOptions, ctx context.Context) (result UrlCheckResult, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			fmt.Printf("Panic in check of %s: %v\n%s", url.path, p, debug.Stack())
+			result = UrlCheckResult{
+				Url: &url,
+				Code: 10,
+				Message: fmt.Sprintf("Internal error: %s", url.path),
+				ErrorKind: ErrorKindPanic}
+			err = fmt.Errorf("internal error in %s", url.path)
+		}
+	}()
+
+	return checkRegions(url, opts, ctx)
+}
+
+/**
+	Url is checked through every requested region at once. The result is the
+	first failed region (or the first region) with all of them attached.
+ */
+func checkRegions(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	if len(opts.Regions) == 0 {
+		return checkSlashes(url, opts, ctx)
+	}
+
+	results := make([]UrlCheckResult, len(opts.Regions))
+	errs := make([]error, len(opts.Regions))
+	wg := sync.WaitGroup{}
+	for i, region := range opts.Regions {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			regionOpts := opts
+			regionOpts.Regions = nil
+			regionOpts.transport = regionTransports[region]
+			results[i], errs[i] = safeCheck(url, regionOpts, ctx)
+			results[i].Region = region
+			results[i].Healthy = errs[i] == nil
+		}(i, region)
+	}
+	wg.Wait()
+
+	pick := 0
+	regions := map[string]UrlCheckResult{}
+	for i, region := range opts.Regions {
+		regions[region] = results[i]
+		if errs[i] != nil && errs[pick] == nil {
+			pick = i
+		}
+	}
+
+	result := results[pick]
+	result.Regions = regions
+	return result, errs[pick]
+}
+
+//Servers 404ing one of /path and /path/ (or redirecting only one) are easy to miss
+func checkSlashes(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	variant := toggleSlash(url.path)
+	if !opts.CompareSlashes || variant == "" {
+		return checkMethods(url, opts, ctx)
+	}
+
+	slash, slashErr := checkMethods(Url{path: variant, index: url.index}, opts, ctx)
+	slash.Healthy = slashErr == nil
+
+	result, err := checkMethods(url, opts, ctx)
+	result.Slash = &slash
+	result.SlashMismatch = slash.Code != result.Code
+	return result, err
+}
+
+//Empty for the site root, "/" and "" are the same request
+func toggleSlash(path string) string {
+	u, err := url.Parse(path); if err != nil || u.Path == "" || u.Path == "/" {
+		return ""
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	} else {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return u.String()
+}
+
+//Servers answering HEAD differently than GET are a common misconfiguration
+func checkMethods(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	if !opts.CompareMethods {
+		return checkHTTP3(url, opts, ctx)
+	}
+
+	headOpts := opts
+	headOpts.Method = http.MethodHead
+	headOpts.Body = ""
+	head, headErr := checkHTTP3(url, headOpts, ctx)
+	head.Healthy = headErr == nil
+
+	result, err := checkHTTP3(url, opts, ctx)
+	result.Head = &head
+	result.MethodMismatch = head.Code != result.Code
+	return result, err
+}
+
+/**
+	QUIC is tried whether Alt-Svc advertises h3 or not, some servers announce it only after a
+	first h2 visit. UDP doesn't go through the dialer (dns cache, dial limits) or region proxies.
+ */
+func checkHTTP3(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	if !opts.CheckHTTP3 || !strings.HasPrefix(strings.ToLower(url.path), "https://") {
+		return checkProtocols(url, opts, ctx)
+	}
+
+	h3Opts := opts
+	h3Opts.http3 = true
+	h3, h3Err := checkSamples(url, h3Opts, ctx)
+	h3.Healthy = h3Err == nil
+
+	result, err := checkProtocols(url, opts, ctx)
+	result.HTTP3 = &h3
+	return result, err
+}
+
+//Same url over HTTP/1.1 only and with HTTP/2 allowed, both times are reported
+func checkProtocols(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	if !opts.CompareProtocols {
+		return checkSamples(url, opts, ctx)
+	}
+
+	http1Opts := opts
+	http1Opts.http1 = true
+	http1, http1Err := checkSamples(url, http1Opts, ctx)
+	http1.Healthy = http1Err == nil
+
+	result, err := checkSamples(url, opts, ctx)
+	result.HTTP1 = &http1
+	result.ProtoMismatch = http1.Code != result.Code
+	return result, err
+}
+
+func checkSamples(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	opts = opts.normalized()
+	samples := opts.Samples
+
+	//Every sample has to pass, the first failed one is reported
+	var result UrlCheckResult
+	var err error
+	var times []float64
+	for i := 0; i < samples; i++ {
+		result, err = checkWithRetries(url, opts, ctx)
+
+		times = append(times, result.Time)
+		if err != nil {
+			break
+		}
+	}
+
+	if samples > 1 {
+		result.Latency = latencyStats(times)
+	}
+	return checker.apply(url, result, err)
+}
+
+func checkWithRetries(url Url, opts CheckOptions, ctx context.Context) (UrlCheckResult, error) {
+	retries := opts.Retries
+
+	var result UrlCheckResult
+	var err error
+	var statuses []int
+	for attempt := 0; ; attempt++ {
+		result, err = checkUrl(url, opts, ctx)
+		statuses = append(statuses, result.Code)
+		if opts.ExpectUnreachable {
+			result, err = invertReachable(url, result, err)
+		}
+		if err != nil && healthyKind(result.ErrorKind, opts.HealthyKinds) {
+			result.Message = fmt.Sprintf("%.2f Expected %s: %s", result.Time, result.ErrorKind, url.path)
+			err = nil
+		}
+		if retries > 0 {
+			result.Attempts = attempt + 1
+			result.AttemptStatuses = statuses
+		}
+
+		retryStatus := err == nil && containsCode(opts.RetryStatuses, result.Code)
+		if (err == nil && !retryStatus) || attempt >= retries {
+			return result, err
+		}
+
+		select {
+			case <-time.After(retryDelay(attempt, opts.RetryJitter)):
+			case <-ctx.Done():
+				return result, err
+		}
+	}
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+	Exponential backoff with jitter, so retries of urls on the same host
+	don't fire in sync. Full jitter is random in [0, backoff),
+	equal jitter keeps half of the backoff and randomizes the rest.
+ */
+func retryDelay(attempt int, jitter string) time.Duration {
+	backoff := RetryBackoff << uint(attempt)
+	if backoff > RetryBackoffMax {
+		backoff = RetryBackoffMax
+	}
+
+	switch jitter {
+		case "none":
+			return backoff
+		case "equal":
+			return backoff/2 + time.Duration(jitterRand.Float64()*float64(backoff/2))
+		default:
+			return time.Duration(jitterRand.Float64() * float64(backoff))
+	}
+}
+
+//Random sources for jitter and shuffle, replaceable with seeded ones
+var jitterRand = newLockedRand(time.Now().UnixNano())
+var shuffleRand = newLockedRand(time.Now().UnixNano() + 1)
+var userAgentRand = newLockedRand(time.Now().UnixNano() + 2)
+var sampleRand = newLockedRand(time.Now().UnixNano() + 3)
+
+//math/rand.Rand is not safe for concurrent checks on its own
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{r: rand.New(rand.NewSource(seed))}
+}
+
+func (l *lockedRand) Float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) Intn(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Intn(n)
+}
+
+func (l *lockedRand) Perm(n int) []int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Perm(n)
+}
+
+func latencyStats(times []float64) *LatencyStats {
+	stats := &LatencyStats{Min: times[0], Max: times[0]}
+	for _, t := range times {
+		stats.Min = math.Min(stats.Min, t)
+		stats.Max = math.Max(stats.Max, t)
+		stats.Mean += t / float64(len(times))
+	}
+
+	for _, t := range times {
+		stats.StdDev += (t - stats.Mean) * (t - stats.Mean) / float64(len(times))
+	}
+	stats.StdDev = math.Sqrt(stats.StdDev)
+
+	return stats
+}
+
+//Request of a check (after punycode and QueryParams), PreviewRequests shows the same
+func newCheckRequest(ctx context.Context, path string, opts CheckOptions) (*http.Request, error) {
+	method := opts.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	//A new reader per attempt, the request keeps GetBody for 307/308 redirects
+	var body io.Reader
+	if opts.Body != "" {
+		body = strings.NewReader(opts.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, body); if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", opts.BodyType)
+		if opts.ExpectContinue {
+			req.Header.Set("Expect", "100-continue")
+		}
+	}
+	if opts.Accept != "" {
+		req.Header.Set("Accept", opts.Accept)
+	}
+	if opts.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", opts.AcceptLanguage)
+	}
+	if opts.userAgent != "" {
+		req.Header.Set("User-Agent", opts.userAgent)
+	}
+	if opts.traceParent != "" {
+		req.Header.Set("Traceparent", opts.traceParent)
+	}
+	return req, nil
+}
+
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+/**
+	Size of the request as HTTP/1.1 writes it, with the Host, User-Agent and Content-Length
+	lines it adds. The transport's own Accept-Encoding is not counted, HTTP/2 sends fewer
+	header bytes (HPACK) but the same body.
+ */
+func requestBytes(req *http.Request) int {
+	sent := req.Clone(context.Background())
+	sent.Body = http.NoBody
+	if req.GetBody != nil {
+		body, err := req.GetBody(); if err == nil {
+			sent.Body = body
+		}
+	}
+	var count byteCounter
+	_ = sent.Write(&count)
+	return int(count)
+}
+
+func checkUrl(url Url, opts CheckOptions, ctx context.Context) (result UrlCheckResult, err error) {
+	//Connection details are filled for failed checks too
+	start := time.Now()
+	var remoteIp string
+	var connReused, earlyHints, gotContinue bool
+	var ttfb float64
+	//Trace callbacks run in the transport's dial and read goroutines, they may outlive a canceled check
+	var phases sync.Mutex
+	var tlsStart, dnsStart, connectStart time.Time
+	var tlsHandshake, dnsTime, connectTime time.Duration
+	phase := func(f func()) {
+		phases.Lock()
+		defer phases.Unlock()
+		f()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			phase(func() { dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			phase(func() { dnsTime = time.Since(dnsStart) })
+		},
+		//Failed connects too, the time until the refusal/timeout
+		ConnectStart: func(string, string) {
+			phase(func() { connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			phase(func() { connectTime = time.Since(connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			phase(func() { tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			phase(func() { tlsHandshake = time.Since(tlsStart) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			phase(func() { connReused = info.Reused })
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				phase(func() { remoteIp = host })
+			}
+		},
+		//Interim responses are skipped by net/http, only noted here
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				phase(func() { earlyHints = true })
+			}
+			return nil
+		},
+		Got100Continue: func() {
+			phase(func() { gotContinue = true })
+		},
+		//Per hop, the last one wins like for the remote ip
+		GotFirstResponseByte: func() {
+			phase(func() { ttfb = time.Since(start).Seconds() })
+		},
+	}
+	var dnsCached atomic.Bool
+	ctx = context.WithValue(ctx, dnsCacheHitKey{}, &dnsCached)
+	defer func() {
+		phase(func() {
+			result.RemoteIP = remoteIp
+			result.ConnReused = connReused
+			result.EarlyHints = earlyHints
+			if opts.ExpectContinue {
+				continued := gotContinue
+				result.GotContinue = &continued
+			}
+			result.TTFB = ttfb
+			result.DNSTime = dnsTime.Seconds()
+			result.ConnectTime = connectTime.Seconds()
+			result.TLSTime = tlsHandshake.Seconds()
+		})
+		result.DNSCached = dnsCached.Load()
+	}()
+
+	if opts.timeout > 0 {
+		defer func() {
+			result.ShortenedTimeout = opts.timeout.Seconds()
+		}()
+	}
+
+	//Own pool for these, connections can't be shared with the plain checks
+	roundTripper := opts.roundTripper()
+	if opts.ServerName != "" {
+		roundTripper = withServerName(roundTripper, opts.ServerName)
+		defer roundTripper.CloseIdleConnections()
+	}
+	if opts.http1 {
+		roundTripper = onlyHTTP1(roundTripper)
+		defer roundTripper.CloseIdleConnections()
+	}
+
+	var clientTransport http.RoundTripper = roundTripper
+	if opts.http3 {
+		quic := h3Transport
+		if opts.ServerName != "" {
+			quic = newH3Transport(roundTripper.TLSClientConfig)
+			defer quic.Close()
+		}
+		clientTransport = quic
+	}
+
+	client := http.Client{
+		Transport: clientTransport,
+		Timeout: opts.urlTimeout(),
+		Jar: opts.jar,
+		CheckRedirect: checkRedirect,
+	}
+	if opts.HTTPSOnlyRedirects {
+		client.CheckRedirect = httpsOnlyRedirect
+	}
+	if !opts.followRedirects() {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	if opts.timeout > 0 {
+		client.Timeout = opts.timeout
+	}
+
+	redirects := 0
+	checkHop := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		err := checkHop(req, via)
+		if err == nil {
+			redirects = len(via)
+		}
+		return err
+	}
+	defer func() {
+		result.RedirectCount = redirects
+	}()
+
+	path, idnHost, punycodeHost := punycodeUrl(url.path)
+	path = withQueryParams(path, opts.QueryParams)
+
+	req, err := newCheckRequest(httptrace.WithClientTrace(ctx, trace), path, opts)
+	if err == nil && opts.ReportRequestBytes {
+		defer func() {
+			result.RequestBytes = requestBytes(req)
+		}()
+	}
+	var resp *http.Response
+	if err == nil {
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		secs := time.Since(start).Seconds()
+		if ip := sniMissing(ctx, err); ip != "" && opts.ServerName == "" {
+			return UrlCheckResult{
+				Url: &url,
+				Code: 10,
+				Message: fmt.Sprintf("%.2f TLS handshake failed, %s gets no SNI (set ServerName to the site host): %s", secs, ip, url.path),
+				Time: secs,
+				ErrorKind: ErrorKindSNIRequired}, fmt.Errorf("%s in %s", ErrorKindSNIRequired, url.path)
+		}
+		if kind, detail := transportErrorKind(ctx, err); kind != "" {
+			return UrlCheckResult{
+				Url: &url,
+				Code: 10,
+				Message: fmt.Sprintf("%.2f %s: %s", secs, detail, url.path),
+				Time: secs,
+				ErrorKind: kind}, fmt.Errorf("%s in %s", kind, url.path)
+		}
+
+		return UrlCheckResult{
+			Url: &url,
+			Code: 10,
+			Message: fmt.Sprintf("%.2f Resp error: %s", secs, url.path),
+			Time: secs}, fmt.Errorf("error (a) in %s", url.path)
+	}
+
+	//Custom round trippers may leave it nil, that's an empty body
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	resp.Body = throttleBody(ctx, resp.Body)
+	defer closeBody(resp.Body, opts.settings())
+
+	buf := getBodyBuffer()
+	defer putBodyBuffer(buf)
+
+	size, err := readBody(resp, opts, buf)
+	if err == errByteBudget {
+		//Abort the download, the rest of the body is not drained
+		_ = resp.Body.Close()
+		secs := time.Since(start).Seconds()
+		return UrlCheckResult{
+			Url: &url,
+			Code: resp.StatusCode,
+			Message: fmt.Sprintf("%.2f Byte budget exceeded: over %d bytes %s", secs, opts.MaxBytes, url.path),
+			Time: secs,
+			ErrorKind: ErrorKindByteBudget}, fmt.Errorf("byte budget exceeded in %s", url.path)
+	}
+	if err != nil && badEncoding(err) {
+		secs := time.Since(start).Seconds()
+		return UrlCheckResult{
+			Url: &url,
+			Code: resp.StatusCode,
+			Message: fmt.Sprintf("%.2f Bad %s encoding after %d bytes: %s", secs, resp.Header.Get("Content-Encoding"), size, url.path),
+			Time: secs,
+			ErrorKind: ErrorKindBadEncoding}, fmt.Errorf("bad content encoding in %s", url.path)
+	}
+	if err != nil && partialResponse(err) {
+		secs := time.Since(start).Seconds()
+		return UrlCheckResult{
+			Url: &url,
+			Code: resp.StatusCode,
+			Message: fmt.Sprintf("%.2f Partial response: %d bytes %s", secs, size, url.path),
+			Time: secs,
+			ErrorKind: ErrorKindPartialResponse}, fmt.Errorf("partial response (%d bytes) in %s", size, url.path)
+	}
+	if err != nil {
+		secs := time.Since(start).Seconds()
+		return UrlCheckResult{
+			Url: &url,
+			Code:resp.StatusCode,
+			Message: fmt.Sprintf("%.2f No body: %s", secs, url.path),
+			Time: secs}, fmt.Errorf("error (b) in %s", url.path)
+	}
+
+	secs := time.Since(start).Seconds()
+
+	message := fmt.Sprintf("%.2f Resp length: %dkb %s code: %d", secs, size/1024, url.path, resp.StatusCode)
+	if noContent(resp) {
+		message = fmt.Sprintf("%.2f No content (%s): %s code: %d", secs, http.StatusText(resp.StatusCode), url.path, resp.StatusCode)
+	}
+
+	check := warningCheck{resp: resp, slowTLS: opts.slowTLS()}
+	phase(func() { check.tlsHandshake = tlsHandshake })
+	result = UrlCheckResult{
+		Url: &url,
+		Code: resp.StatusCode,
+		Message: message,
+		Time: secs,
+		Trailers: pickTrailers(resp, opts.Trailers),
+		IdnHost: idnHost,
+		PunycodeHost: punycodeHost,
+		OCSPStatus: ocspStatus(resp, opts),
+		SNI: sni(resp),
+		Proto: resp.Proto,
+		FinalUrl: finalUrl(resp, path),
+		CacheStatus: cacheStatus(resp),
+		StatusText: statusText(resp),
+		Warnings: warnings(opts.WarnOn, check)}
+
+	//SlowTLSMs is a threshold of its own, slow_tls in WarnOn or not
+	if opts.SlowTLSMs > 0 {
+		if warning := warningRules["slow_tls"](check); warning != "" {
+			if !hasString(opts.WarnOn, "slow_tls") {
+				result.Warnings = append(result.Warnings, warning)
+			}
+			result.degraded = true
+		}
+	}
+
+	if opts.ReportAge {
+		result.ResponseAge = responseAge(resp, start, time.Now())
+	}
+
+	if opts.CheckHTTP3 && !opts.http3 {
+		result.H3Advertised = altSvcH3(resp)
+	}
+	if opts.ReportAltSvc {
+		result.AltSvc = altSvc(resp)
+	}
+
+	//Stale stapling is degraded, not down
+	if result.OCSPStatus == "stale" {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("stale OCSP staple (older than %ds)", opts.OCSPMaxAge))
+		result.degraded = true
+	}
+
+	if opts.ExpectBodyBytes != nil && size != int64(*opts.ExpectBodyBytes) {
+		result.Message = fmt.Sprintf("%.2f Body of %d bytes, expected %d: %s code: %d", secs, size, *opts.ExpectBodyBytes, url.path, resp.StatusCode)
+		result.ErrorKind = ErrorKindBodySize
+		return result, fmt.Errorf("body size mismatch in %s", url.path)
+	}
+
+	if opts.RedirectsUnhealthy && isRedirect(resp) {
+		result.Message = fmt.Sprintf("%.2f Redirect to %s: %s code: %d", secs, resp.Header.Get("Location"), url.path, resp.StatusCode)
+		result.ErrorKind = ErrorKindRedirect
+		return result, fmt.Errorf("redirect in %s", url.path)
+	}
+
+	if opts.HashBody {
+		sum := sha256.Sum256(buf.Bytes())
+		result.BodyHash = hex.EncodeToString(sum[:])
+	}
+
+	if opts.ReturnBodyLines > 0 {
+		result.BodyLines, result.LineCount = bodyLines(resp, buf.Bytes(), opts.ReturnBodyLines)
+	}
+
+	if opts.CheckMetaRefresh {
+		if target, ok := metaRefresh(resp, buf.Bytes()); ok {
+			result.MetaRefresh = target
+			if samePage(resp, target) {
+				result.Message = fmt.Sprintf("%.2f Meta refresh to itself: %s code: %d", secs, url.path, resp.StatusCode)
+				result.ErrorKind = ErrorKindMetaRefreshLoop
+				return result, fmt.Errorf("meta refresh loop in %s", url.path)
+			}
+		}
+	}
+
+	if opts.jsonSchema != nil {
+		problems, err := schemaErrors(resp, buf.Bytes(), opts.jsonSchema)
+		if err != nil {
+			result.Message = fmt.Sprintf("%.2f Not JSON (%s): %s code: %d", secs, err, url.path, resp.StatusCode)
+			result.ErrorKind = ErrorKindNotJSON
+			return result, fmt.Errorf("not json in %s", url.path)
+		}
+		if len(problems) > 0 {
+			result.SchemaErrors = problems
+			result.Message = fmt.Sprintf("%.2f Schema mismatch: %s %s code: %d", secs, problems[0], url.path, resp.StatusCode)
+			result.ErrorKind = ErrorKindSchemaMismatch
+			return result, fmt.Errorf("schema mismatch in %s", url.path)
+		}
+	}
+
+	if opts.Accept != "" || opts.AcceptLanguage != "" {
+		result.ContentType = resp.Header.Get("Content-Type")
+		result.ContentLanguage = resp.Header.Get("Content-Language")
+	}
+
+	if opts.ExpectRedirectTo != "" {
+		result.Location = resp.Header.Get("Location")
+		if !isRedirect(resp) || !redirectsTo(resp, opts.ExpectRedirectTo) {
+			result.Message = fmt.Sprintf("%.2f Redirect to %q, expected %q: %s code: %d", secs, result.Location, opts.ExpectRedirectTo, url.path, resp.StatusCode)
+			result.ErrorKind = ErrorKindRedirectTarget
+			return result, fmt.Errorf("unexpected redirect target in %s", url.path)
+		}
+	}
+
+	if opts.MaxHeaders > 0 {
+		for _, values := range resp.Header {
+			result.HeaderCount += len(values)
+		}
+		if result.HeaderCount > opts.MaxHeaders {
+			result.Message = fmt.Sprintf("%.2f Too many headers: %d over %d %s code: %d", secs, result.HeaderCount, opts.MaxHeaders, url.path, resp.StatusCode)
+			result.ErrorKind = ErrorKindTooManyHeaders
+			return result, fmt.Errorf("too many headers in %s", url.path)
+		}
+	}
+
+	if opts.RequireHSTS {
+		if problem := hstsProblem(resp, opts.HSTSMinAge); problem != "" {
+			result.Message = fmt.Sprintf("%.2f HSTS %s: %s code: %d", secs, problem, url.path, resp.StatusCode)
+			result.ErrorKind = ErrorKindHSTS
+			return result, fmt.Errorf("hsts %s in %s", problem, url.path)
+		}
+	}
+
+	return result, nil
+}
+
+//Strict-Transport-Security is only honored over https and needs a long enough max-age
+func hstsProblem(resp *http.Response, minAge int64) string {
+	if resp.TLS == nil {
+		return "needs https"
+	}
+
+	header := resp.Header.Get("Strict-Transport-Security")
+	if header == "" {
+		return "missing"
+	}
+
+	for _, directive := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+
+		age, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64); if err != nil {
+			return "bad max-age"
+		}
+		if age < minAge {
+			return fmt.Sprintf("max-age %d < %d", age, minAge)
+		}
+		return ""
+	}
+
+	return "no max-age"
+}
+
+//Url the redirects ended at, "" when the requested url answered itself
+func finalUrl(resp *http.Response, requested string) string {
+	if resp.Request == nil || resp.Request.URL.String() == requested {
+		return ""
+	}
+	return resp.Request.URL.String()
+}
+
+/**
+	ExpectJSONSchema given as a string is the url of the schema, fetched once per batch like
+	UrlsSource pages (public hosts only). $refs are loaded the same way, never from local files.
+ */
+func compileSchema(ctx context.Context, raw json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	loader := schemaLoader{ctx: ctx}
+	compiler.UseLoader(jsonschema.SchemeURLLoader{"http": loader, "https": loader})
+
+	var location string
+	if err := json.Unmarshal(raw, &location); err == nil {
+		return compiler.Compile(location)
+	}
+
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw)); if err != nil {
+		return nil, err
+	}
+	if err := compiler.AddResource("inline.json", doc); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("inline.json")
+}
+
+type schemaLoader struct {
+	ctx context.Context
+}
+
+func (l schemaLoader) Load(location string) (any, error) {
+	data, err := fetchSourcePage(l.ctx, location); if err != nil {
+		return nil, err
+	}
+	return jsonschema.UnmarshalJSON(bytes.NewReader(data))
+}
+
+//Errors only for a body that isn't JSON (by Content-Type or content), mismatches are the list
+func schemaErrors(resp *http.Response, body []byte, schema *jsonschema.Schema) ([]string, error) {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return nil, fmt.Errorf("content type %q", resp.Header.Get("Content-Type"))
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(body)); if err != nil {
+		return nil, fmt.Errorf("bad body")
+	}
+
+	var validation *jsonschema.ValidationError
+	if err := schema.Validate(doc); !errors.As(err, &validation) {
+		return nil, nil
+	}
+	var problems []string
+	for _, unit := range validation.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		if len(problems) == SchemaErrorLimit {
+			break
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		problems = append(problems, location + ": " + unit.Error.String())
+	}
+	if len(problems) == 0 {
+		problems = append(problems, validation.Error())
+	}
+	return problems, nil
+}
+
+var metaRefreshTag = regexp.MustCompile(`(?is)<meta\s[^>]*http-equiv\s*=\s*["']?refresh["']?[^>]*>`)
+var metaContent = regexp.MustCompile(`(?is)\scontent\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+
+/**
+	Target of the first meta refresh of an HTML body, resolved against the final url:
+	content="5; url=/next" (url may be quoted), just "5" reloads the page itself.
+ */
+func metaRefresh(resp *http.Response, body []byte) (string, bool) {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	if mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";"); strings.TrimSpace(mediaType) != "text/html" {
+		return "", false
+	}
+
+	tag := metaRefreshTag.Find(body)
+	if tag == nil {
+		return "", false
+	}
+	match := metaContent.FindSubmatch(tag)
+	if match == nil {
+		return "", false
+	}
+	content := string(match[1]) + string(match[2]) + string(match[3])
+
+	_, target, _ := strings.Cut(content, ";")
+	target = strings.TrimSpace(target)
+	if len(target) >= 4 && strings.EqualFold(target[:4], "url=") {
+		target = strings.TrimSpace(target[4:])
+	}
+	target = strings.Trim(target, `"'`)
+
+	if resp.Request == nil {
+		return target, true
+	}
+	resolved, err := resp.Request.URL.Parse(target); if err != nil {
+		return target, true
+	}
+	return resolved.String(), true
+}
+
+//Fragment doesn't make it another page
+func samePage(resp *http.Response, target string) bool {
+	if resp.Request == nil {
+		return false
+	}
+	u, err := url.Parse(target); if err != nil {
+		return false
+	}
+	u.Fragment = ""
+	page := *resp.Request.URL
+	page.Fragment = ""
+	return u.String() == page.String()
+}
+
+//No h2 in ALPN
+func onlyHTTP1(t *http.Transport) *http.Transport {
+	t = t.Clone()
+	t.ForceAttemptHTTP2 = false
+	t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if t.TLSClientConfig != nil {
+		t.TLSClientConfig.NextProtos = nil
+	}
+	return t
+}
+
+/**
+	First n lines of a text body (by Content-Type, sniffed when missing)
+	and its line count. Binary bodies return nothing.
+ */
+func bodyLines(resp *http.Response, body []byte, n int) ([]string, int) {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	if !textContent(contentType) || !utf8.Valid(body) || len(body) == 0 {
+		return nil, 0
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	count := len(lines)
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines, count
+}
+
+func textContent(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" ||
+		mediaType == "application/xml" || mediaType == "application/javascript" ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+//HTTP/3 checks share a pool (and one UDP socket), ServerName checks get their own
+var h3Transport = newH3Transport(transport.TLSClientConfig)
+
+func newH3Transport(tlsConfig *tls.Config) *http3.Transport {
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = nil
+	}
+	return &http3.Transport{TLSClientConfig: tlsConfig}
+}
+
+//One list of all Alt-Svc headers, empty entries dropped ("clear" withdraws earlier ones)
+func altSvc(resp *http.Response) string {
+	var services []string
+	for _, header := range resp.Header.Values("Alt-Svc") {
+		for _, service := range strings.Split(header, ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				services = append(services, service)
+			}
+		}
+	}
+	return strings.Join(services, ", ")
+}
+
+//Alt-Svc: h3=":443"; ma=86400, h3-29=":443" (drafts count too)
+func altSvcH3(resp *http.Response) bool {
+	for _, header := range resp.Header.Values("Alt-Svc") {
+		for _, service := range strings.Split(header, ",") {
+			protocol, _, _ := strings.Cut(strings.TrimSpace(service), "=")
+			if protocol == "h3" || strings.HasPrefix(protocol, "h3-") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-//Response to client
-type CheckResponse struct {
-	Urls []UrlCheckResult `json:"urls"`
+func withServerName(t *http.Transport, serverName string) *http.Transport {
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.ServerName = serverName
+	return t
 }
 
-//Url
-type Url struct {
-	path string
+/**
+	No SNI is sent for an IP host, servers hosting several names then reject the handshake
+	or present a default certificate. Returns the IP when an https request to one failed that way.
+ */
+func sniMissing(ctx context.Context, err error) string {
+	var urlErr *url.Error
+	if ctx.Err() != nil || !errors.As(err, &urlErr) {
+		return ""
+	}
+	u, parseErr := url.Parse(urlErr.URL); if parseErr != nil || u.Scheme != "https" || net.ParseIP(u.Hostname()) == nil {
+		return ""
+	}
+
+	//TLS alert from the server (handshake failure, unrecognized name) or a default certificate for another name
+	var opErr *net.OpError
+	var hostname x509.HostnameError
+	if (errors.As(err, &opErr) && opErr.Op == "remote error") || errors.As(err, &hostname) {
+		return u.Hostname()
+	}
+	return ""
 }
 
-//Url with check result
-type UrlCheckResult struct {
-	Url *Url `json:"url"`
-	Code int `json:"code"`
-	Message  string `json:"message"`
-	Time     float64
+func sni(resp *http.Response) string {
+	if resp.TLS == nil {
+		return ""
+	}
+	return resp.TLS.ServerName
+}
+
+//What warning rules look at
+type warningCheck struct {
+	resp         *http.Response
+	tlsHandshake time.Duration
+	slowTLS      time.Duration
+}
+
+//WarnOn rules, each returns the warning or "" when all is fine
+var warningRules = map[string]func(check warningCheck) string{
+	"slow_tls": func(check warningCheck) string {
+		if check.tlsHandshake > check.slowTLS {
+			return fmt.Sprintf("slow TLS handshake (%s)", check.tlsHandshake.Round(time.Millisecond))
+		}
+		return ""
+	},
+	"no_cache_control": func(check warningCheck) string {
+		if check.resp.Header.Get("Cache-Control") == "" {
+			return "missing Cache-Control"
+		}
+		return ""
+	},
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func warnings(rules []string, check warningCheck) []string {
+	var found []string
+	for _, rule := range rules {
+		if warning := warningRules[rule](check); warning != "" {
+			found = append(found, warning)
+		}
+	}
+	return found
+}
+
+//Status minus the code, the standard text when the server sent none
+func statusText(resp *http.Response) string {
+	if text := strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))); text != "" {
+		return text
+	}
+	return http.StatusText(resp.StatusCode)
 }
 
 /**
-	HTTP server limit (f.e.  100 connection per second)
+	Current age as RFC 9111 4.2.3 computes it: the larger of the apparent age (Date to now)
+	and the Age caches added plus the request's own delay. Skewed clocks keep it at 0 or above.
  */
-var limiter = rate.NewLimiter(HttpLimitPerSecons, HttpLimitPerSeconsBoost)
-func limit(next http.Handler) http.Handler {
+func responseAge(resp *http.Response, requested time.Time, received time.Time) float64 {
+	apparent := 0.0
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		apparent = math.Max(0, received.Sub(date).Seconds())
+	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if limiter.Allow() == false {
-			http.Error(w, http.StatusText(429), http.StatusTooManyRequests)
-			return
+	ageHeader, err := strconv.ParseFloat(resp.Header.Get("Age"), 64); if err != nil || ageHeader < 0 {
+		return apparent
+	}
+	corrected := ageHeader + received.Sub(requested).Seconds()
+	return math.Max(apparent, corrected)
+}
+
+/**
+	CF-Cache-Status, X-Cache-Status (nginx) or X-Cache (CloudFront, Fastly, Varnish:
+	"Hit from cloudfront", "MISS, HIT" - the last is the edge), Age alone means a hit.
+ */
+func cacheStatus(resp *http.Response) string {
+	for _, name := range []string{"CF-Cache-Status", "X-Cache-Status", "X-Cache"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
 		}
 
-		next.ServeHTTP(w, r)
-	})
+		hops := strings.Split(strings.ToUpper(value), ",")
+		edge := hops[len(hops)-1]
+		switch {
+			case strings.Contains(edge, "STALE"), strings.Contains(edge, "EXPIRED"), strings.Contains(edge, "UPDATING"):
+				return "stale"
+			case strings.Contains(edge, "HIT"), strings.Contains(edge, "REVALIDATED"):
+				return "hit"
+			case strings.Contains(edge, "MISS"), strings.Contains(edge, "BYPASS"), strings.Contains(edge, "DYNAMIC"):
+				return "miss"
+		}
+	}
+
+	if age, err := strconv.Atoi(resp.Header.Get("Age")); err == nil && age > 0 {
+		return "hit"
+	}
+	return ""
 }
 
-func main() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/check", checkHandler)
+//Location as sent, or resolved against the url when it's relative
+func redirectsTo(resp *http.Response, expected string) bool {
+	if resp.Header.Get("Location") == expected {
+		return true
+	}
+	location, err := resp.Location()
+	return err == nil && location.String() == expected
+}
 
-	server := &http.Server{
-		Addr: PORT,
-		Handler: limit(mux),
-		ReadTimeout:  time.Minute,
-		WriteTimeout: time.Minute,
+//3xx pointing somewhere else (304 is a cache answer, not a redirect)
+func isRedirect(resp *http.Response) bool {
+	return resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.StatusCode != http.StatusNotModified
+}
+
+/**
+	Status of the OCSP response stapled to the TLS handshake.
+	Signature is verified against the issuer when the server sent the chain.
+ */
+func ocspStatus(resp *http.Response, opts CheckOptions) string {
+	if !opts.ReportOCSP || resp.TLS == nil {
+		return ""
+	}
+	if len(resp.TLS.OCSPResponse) == 0 {
+		return "none"
 	}
 
-	//Graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt)
+	var issuer *x509.Certificate
+	if len(resp.TLS.PeerCertificates) > 1 {
+		issuer = resp.TLS.PeerCertificates[1]
+	}
 
-	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			fmt.Printf("Error: %v\n", err)
-			stop <- os.Kill
-			return
-		}
-		fmt.Println("Server started.")
-	}()
+	stapled, err := ocsp.ParseResponse(resp.TLS.OCSPResponse, issuer); if err != nil {
+		return "invalid"
+	}
 
-	<-stop
+	switch stapled.Status {
+		case ocsp.Good:
+			if opts.OCSPMaxAge > 0 && time.Since(stapled.ThisUpdate) > time.Duration(opts.OCSPMaxAge)*time.Second {
+				return "stale"
+			}
+			return "good"
+		case ocsp.Revoked:
+			return "revoked"
+		default:
+			return "unknown"
+	}
+}
 
-	if err := server.Shutdown(context.Background()); err != nil {
-		fmt.Println("Server error...")
+//Params replace same-named ones already in the url
+func withQueryParams(path string, params map[string]string) string {
+	if len(params) == 0 {
+		return path
 	}
 
-	fmt.Println("Server stopped.")
+	u, err := url.Parse(path); if err != nil {
+		return path
+	}
+
+	query := u.Query()
+	for k, v := range params {
+		query.Set(k, v)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
 }
 
-func checkHandler(w http.ResponseWriter, r *http.Request) {
-	g, ctx := errgroup.WithContext(r.Context())
+/**
+	Internationalized hosts (münchen.de) are converted to punycode before connecting,
+	both forms are returned when they differ. Unparsable urls are left to the client.
+ */
+func punycodeUrl(path string) (string, string, string) {
+	u, err := url.Parse(path); if err != nil {
+		return path, "", ""
+	}
 
-	//Decode request
-	var req CheckRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	host := u.Hostname()
+	ascii, err := idna.Lookup.ToASCII(host); if err != nil || ascii == host {
+		return path, "", ""
 	}
 
-	if len(req.Urls) > UrlLimit {
-		http.Error(w, "{'error' : 'to many urls'}", http.StatusBadRequest)
-		return
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(ascii, port)
+	} else {
+		u.Host = ascii
 	}
 
+	return u.String(), host, ascii
+}
 
-	resultChan := make(chan UrlCheckResult)
-	defer close(resultChan)
+/**
+	ExpectUnreachable: only a failed DNS lookup or connect is the healthy outcome.
+	Any answer of the server (TLS errors, bad bodies...) means the url is reachable,
+	a batch timeout, cancel or local failure tells nothing and keeps its own kind.
+ */
+var unreachableKinds = []string{ErrorKindConnectFailed, ErrorKindDNSNotFound, ErrorKindDNSTimeout}
 
-	//Wait group for urls checks
-	gr := sync.WaitGroup{}
-	gr.Add(len(req.Urls))
+var notTriedKinds = []string{ErrorKindBatchTimeout, ErrorKindCanceled, ErrorKindClientCanceled, ErrorKindTooManyFiles}
 
-	//Parallel limit
-	limitQueue := make(chan string, LimitOutgoingConnections)
-	defer close(limitQueue)
+func invertReachable(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+	if err != nil && healthyKind(result.ErrorKind, unreachableKinds) {
+		result.Message = fmt.Sprintf("%.2f Unreachable as expected: %s", result.Time, url.path)
+		return result, nil
+	}
+	if err != nil && healthyKind(result.ErrorKind, notTriedKinds) {
+		return result, err
+	}
 
-	/**
-		Goroutine that handle check result.
-	*/
-	var CheckResult []UrlCheckResult
-	go func(resultChan chan UrlCheckResult) {
-		for {
-			if checkResult, ok := <-resultChan; ok {
-				if checkResult.Code > 0 {
-					//fmt.Printf("done: %s %d %s\n", checkResult.Url.path, checkResult.Code, checkResult.Message)
-				} else {
-					//fmt.Printf("done (ignore): %s\n", checkResult.Url.path)
-				}
+	result.Message = fmt.Sprintf("%.2f Reachable, expected unreachable: %s code: %d", result.Time, url.path, result.Code)
+	result.ErrorKind = ErrorKindReachable
+	return result, fmt.Errorf("reachable %s", url.path)
+}
 
-				CheckResult = append(CheckResult, checkResult)
-				<-limitQueue
-				gr.Done()
-			} else {
-				break
-			}
+//Error kind is kept in the result, it tells why it's healthy
+func healthyKind(kind string, kinds []string) bool {
+	for _, k := range kinds {
+		if kind != "" && k == kind {
+			return true
 		}
-	}(resultChan)
+	}
+	return false
+}
 
-	/**
-		Workers that checks urls
-	*/
-	for _, path := range req.Urls {
-		limitQueue <- path
-		path := path
+/**
+	Body is buffered only when some option looks into it, otherwise it's
+	counted while discarding: closeBody drains up to DrainLimit for reuse anyway,
+	and reading it shows a connection closed early (partial_response).
+	A bigger body is sized from Content-Length without being read, unless DiscardBody.
+ */
+func readBody(resp *http.Response, opts CheckOptions, buf *bytes.Buffer) (int64, error) {
+	config := opts.settings()
+	if noContent(resp) {
+		return 0, nil
+	}
 
-		g.Go(func() error {
-			select {
-				case <-ctx.Done():
-					resultChan <- UrlCheckResult{Url: &Url{path: path}}
-					return fmt.Errorf("cancelled by client")
-				default:
-			}
+	limit := config.BodyLimit
+	if opts.MaxBytes > 0 {
+		if resp.ContentLength > opts.MaxBytes {
+			return 0, errByteBudget
+		}
+		//One byte over the budget is enough to know it's exceeded
+		if opts.MaxBytes < limit {
+			limit = opts.MaxBytes + 1
+		}
+	}
 
-			res := CheckUrl(Url{path: path}, resultChan, ctx)
-			return res
-		})
+	body := io.LimitReader(resp.Body, limit)
+
+	var size int64
+	var err error
+	if opts.needsBody() {
+		size, err = buf.ReadFrom(body)
+	} else if resp.ContentLength > config.DrainLimit && opts.ExpectBodyBytes == nil && !opts.DiscardBody {
+		return resp.ContentLength, nil
+	} else {
+		size, err = io.Copy(io.Discard, body)
 	}
 
-	if err := g.Wait(); err != nil {
-		//fmt.Printf("Urls has error: %v", err)
-		fmt.Print(".")
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if opts.MaxBytes > 0 && size > opts.MaxBytes {
+		return size, errByteBudget
 	}
+	return size, err
+}
 
-	gr.Wait()
-	fmt.Print("+")
-	w.Header().Set("Content-Type", "application/json")
+var errByteBudget = errors.New("byte budget exceeded")
 
-	fooMarshalled, err := json.Marshal( CheckResponse{Urls: CheckResult}); if err != nil {
-		_, err = fmt.Fprint(w, "{}"); if err != nil {
-			fmt.Print("0")
+//204 and 304 have no body by definition
+func noContent(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified
+}
+
+/**
+	Outgoing bandwidth limit shared by all checks, a token is one byte.
+	Burst is a second worth of bytes, so a single read never waits longer.
+ */
+var bandwidth = newBandwidthLimiter()
+
+func newBandwidthLimiter() *rate.Limiter {
+	config := currentConfig()
+	if config.BandwidthLimit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(config.BandwidthLimit), config.BandwidthLimit)
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func throttleBody(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if bandwidth == nil {
+		return body
+	}
+	return &throttledBody{ReadCloser: body, ctx: ctx}
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > bandwidth.Burst() {
+		p = p[:bandwidth.Burst()]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := bandwidth.WaitN(b.ctx, n); werr != nil {
+			return n, werr
 		}
-		return
 	}
+	return n, err
+}
 
-	_, err = fmt.Fprint(w, string(fooMarshalled)); if err != nil {
-		fmt.Print("!")
+//Redirect chain came back to an already visited url
+type redirectLoopError struct {
+	url string
+}
+
+func (e *redirectLoopError) Error() string {
+	return "redirect loop at " + e.url
+}
+
+//Redirect to plain http was refused
+type downgradeRedirectError struct {
+	url string
+}
+
+func (e *downgradeRedirectError) Error() string {
+	return "downgrade redirect blocked at " + e.url
+}
+
+func httpsOnlyRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme == "http" {
+		return &downgradeRedirectError{url: req.URL.String()}
+	}
+	return checkRedirect(req, via)
+}
+
+/**
+	Redirects are followed up to 10 hops like by default,
+	a chain revisiting a url is stopped right away as a loop.
+	Bodies of intermediate hops are never measured: net/http reads at most 2kb
+	of each (for connection reuse) and closes it, only the final body is ours.
+ */
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return &redirectLoopError{url: req.URL.String()}
+		}
+	}
+
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
 	}
+	return nil
 }
 
-func CheckUrl(url Url, ch chan <- UrlCheckResult, ctx context.Context) error {
-	time.Sleep(0 * time.Second)
+/**
+	Code 0 placeholder for an url that was never checked, the kind tells why:
+	server busy (queue_timeout), batch deadline, client gone or another url failed the batch.
+ */
+func notChecked(url Url, ctx context.Context, err error) UrlCheckResult {
+	kind, detail := ErrorKindNotAttempted, "Not attempted, batch failed"
+	switch {
+		case err == errBusy:
+			kind, detail = ErrorKindQueueTimeout, "Not attempted, queue timeout"
+		case ctx.Err() == context.DeadlineExceeded:
+			kind, detail = ErrorKindBatchTimeout, "Not attempted, batch timeout"
+		case ctx.Err() == context.Canceled && context.Cause(ctx) == context.Canceled:
+			kind, detail = ErrorKindClientCanceled, "Not attempted, canceled by client"
+	}
+	return UrlCheckResult{
+		Url: &url,
+		Index: url.index,
+		Message: fmt.Sprintf("0.00 %s: %s", detail, url.path),
+		ErrorKind: kind}
+}
 
-	start := time.Now()
-	client := http.Client{
-		Timeout: 1 * time.Second,
-		//CheckRedirect: func(req *http.Request, via []*http.Request) error {
-		//	return http.ErrUseLastResponse
-		//},
+/**
+	Known transport failures get a kind and a readable detail,
+	everything else stays a generic "Resp error".
+ */
+func transportErrorKind(ctx context.Context, err error) (string, string) {
+	//Batch context ended: X-Deadline, client gone or another url failed the batch
+	switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return ErrorKindBatchTimeout, "Batch timeout"
+		case context.Canceled:
+			if context.Cause(ctx) == context.Canceled {
+				return ErrorKindClientCanceled, "Canceled by client"
+			}
+			return ErrorKindCanceled, "Canceled, batch failed"
 	}
 
-	resp, err := client.Get(url.path); if err != nil {
-		secs := time.Since(start).Seconds()
-		ch <- UrlCheckResult{
-			Url: &url,
-			Code: 10,
-			Message: fmt.Sprintf("%.2f Resp error: %s", secs, url.path),
-			Time: secs}
+	var loop *redirectLoopError
+	if errors.As(err, &loop) {
+		return ErrorKindRedirectLoop, "Redirect loop at " + loop.url
+	}
 
-		return fmt.Errorf("error (a) in %s", url.path)
+	var downgrade *downgradeRedirectError
+	if errors.As(err, &downgrade) {
+		return ErrorKindDowngrade, "Downgrade redirect blocked (" + downgrade.url + ")"
 	}
 
-	body, err := ioutil.ReadAll(resp.Body); if err != nil {
-		secs := time.Since(start).Seconds()
-		ch <- UrlCheckResult{
-			Url: &url,
-			Code:resp.StatusCode,
-			Message: fmt.Sprintf("%.2f No body: %s", secs, url.path),
-			Time: secs}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return ErrorKindDNSNotFound, "DNS not found (" + dnsErr.Name + ")"
+	}
 
-		return fmt.Errorf("error (b) in %s", url.path)
+	var dnsTimeout *dnsTimeoutError
+	if errors.As(err, &dnsTimeout) {
+		return ErrorKindDNSTimeout, "DNS timeout (" + dnsTimeout.host + ")"
 	}
 
-	defer resp.Body.Close()
+	if tooManyFiles(err) {
+		return ErrorKindTooManyFiles, "Too many open files (raise ulimit -n or lower concurrency)"
+	}
 
-	secs := time.Since(start).Seconds()
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return ErrorKindTlsUntrusted, "TLS untrusted (unknown authority, self-signed?)"
+	}
 
-	ch <- UrlCheckResult{
-		Url: &url,
-		Code: resp.StatusCode,
-		Message: fmt.Sprintf("%.2f Resp length: %dkb %s code: %d", secs, len(body)/1024, url.path, resp.StatusCode),
-		Time: secs}
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) {
+		return ErrorKindTlsUntrusted, "TLS untrusted (" + invalid.Error() + ")"
+	}
 
-	return nil
+	//Refused, unreachable or no answer to the SYN: the server never saw the request
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		if opErr.Timeout() {
+			return ErrorKindConnectFailed, "Connect timeout"
+		}
+		return ErrorKindConnectFailed, "Connect failed (" + opErr.Err.Error() + ")"
+	}
+
+	//Per url client timeout
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorKindUrlTimeout, "URL timeout"
+	}
+
+	return "", ""
+}
+
+//Requested trailers that the server actually sent
+func pickTrailers(resp *http.Response, names []string) map[string]string {
+	var trailers map[string]string
+	for _, name := range names {
+		if v := resp.Trailer.Get(name); v != "" {
+			if trailers == nil {
+				trailers = map[string]string{}
+			}
+			trailers[name] = v
+		}
+	}
+	return trailers
+}
+
+/**
+	Corrupt gzip body under Content-Encoding (net/http decompresses it
+	transparently). A body cut short in the middle stays a partial response.
+ */
+func badEncoding(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, &corrupt)
+}
+
+//Server sent a part of the body and closed or reset the connection
+func partialResponse(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+/**
+	Keep-alive connection goes back to the pool only when the body was read to EOF,
+	so a bounded rest is drained first. Bigger leftovers aren't worth it.
+ */
+func closeBody(body io.ReadCloser, config *Config) {
+	if config.DrainLimit > 0 {
+		_, _ = io.CopyN(io.Discard, body, config.DrainLimit)
+	}
+	_ = body.Close()
+}
+
+/**
+	Buffers for reading checked bodies, reused between checks to keep GC calm.
+	Buffers grown far beyond the usual size are dropped instead of pooled.
+ */
+const bodyBufferKeepLimit = 1 << 20
+
+var bodyBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBodyBuffer() *bytes.Buffer {
+	buf := bodyBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > bodyBufferKeepLimit {
+		return
+	}
+	buf.Reset()
+	bodyBufferPool.Put(buf)
 }
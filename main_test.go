@@ -0,0 +1,3190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/time/rate"
+	"io"
+	"math"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/**
+	Helpers. Tests change package state (config, transport, hooks, random sources),
+	so they don't run in parallel and put everything back in t.Cleanup.
+ */
+
+//Config with the change applied is live until the test ends
+func setConfig(t *testing.T, change func(config *Config)) *Config {
+	running := currentConfig()
+	changed := *running
+	change(&changed)
+	liveConfig.Store(&changed)
+	t.Cleanup(func() { liveConfig.Store(running) })
+	return &changed
+}
+
+func serve(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func serveTLS(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+//Shared transport trusts the test certificate (every httptest TLS server has the same one)
+func trustTestCert(t *testing.T, srv *httptest.Server) {
+	saved := transport
+	transport = newTransport()
+	transport.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	t.Cleanup(func() {
+		transport.CloseIdleConnections()
+		transport = saved
+	})
+}
+
+func useHooks(t *testing.T, hooks ...ResultHook) {
+	saved := checker
+	checker = &Checker{}
+	for _, hook := range hooks {
+		checker.Use(hook)
+	}
+	t.Cleanup(func() { checker = saved })
+}
+
+//Url nothing listens on
+func closedUrl(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0"); if err != nil {
+		t.Fatal(err)
+	}
+	_ = ln.Close()
+	return "http://" + ln.Addr().String()
+}
+
+//Same server under another host name, for batches with several hosts
+func otherHost(srv *httptest.Server) string {
+	return strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+}
+
+func paths(base string, n int) []string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = fmt.Sprintf("%s/%d", base, i)
+	}
+	return list
+}
+
+//Request body with the urls and more fields ("Chain":true)
+func batch(options string, urls ...string) string {
+	list, _ := json.Marshal(append([]string{}, urls...))
+	if options == "" {
+		return `{"urls":` + string(list) + `}`
+	}
+	return `{"urls":` + string(list) + `,` + options + `}`
+}
+
+//POST /check straight to the handler, header is name, value pairs
+func postCheck(body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	checkHandler(rec, req)
+	return rec
+}
+
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) CheckResponse {
+	t.Helper()
+	var response CheckResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%d %s: %v", rec.Code, rec.Body.String(), err)
+	}
+	return response
+}
+
+//Check of a single url the way a batch runs it
+func checkOne(path string, opts CheckOptions) (UrlCheckResult, error) {
+	ch := make(chan UrlCheckResult, 1)
+	err := CheckUrl(Url{path: path}, opts, ch, context.Background())
+	return <-ch, err
+}
+
+func serveCounter(t *testing.T, hits *int32) *httptest.Server {
+	return serve(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+	})
+}
+
+//Most requests the server handled at once
+type peakCounter struct {
+	active, peak int32
+}
+
+func (p *peakCounter) enter() {
+	n := atomic.AddInt32(&p.active, 1)
+	for {
+		peak := atomic.LoadInt32(&p.peak)
+		if n <= peak || atomic.CompareAndSwapInt32(&p.peak, peak, n) {
+			return
+		}
+	}
+}
+
+func (p *peakCounter) leave() {
+	atomic.AddInt32(&p.active, -1)
+}
+
+func TestChainStopsAtFailedStep(t *testing.T) {
+	var hits int32
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+			case "/login":
+				http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+			case "/account":
+				if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "s1" {
+					w.WriteHeader(http.StatusForbidden)
+				}
+		}
+	})
+
+	rec := postCheck(batch(`"Chain":true`, closedUrl(t), srv.URL+"/login"))
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "'cause' : 'fail_fast'") || hits != 0 {
+		t.Fatal(rec.Code, rec.Body.String(), hits)
+	}
+
+	response := decodeResponse(t, postCheck(batch(`"Chain":true`, srv.URL+"/login", srv.URL+"/account")))
+	if len(response.Urls) != 2 || response.Urls[1].Code != 200 || response.MaxInFlight != 1 || hits != 2 {
+		t.Fatal(response.Urls, hits)
+	}
+	//The deadline cuts the host delay before the next step, the chain stops there
+	start := time.Now()
+	rec = postCheck(batch(`"Chain":true,"HostDelayMs":1000`, srv.URL+"/login", srv.URL+"/account"), "X-Deadline", "0.2")
+	response = decodeResponse(t, rec)
+	if !response.Partial || len(response.Urls) != 1 || hits != 3 || time.Since(start) > 700*time.Millisecond {
+		t.Fatal(rec.Body.String(), hits)
+	}
+
+	for _, options := range []string{`"Chain":true,"Stream":true`, `"Chain":true,"ErrorBudget":1`} {
+		if rec := postCheck(batch(options, srv.URL+"/login")); rec.Code != 400 || !strings.Contains(rec.Body.String(), "with Chain") {
+			t.Fatal(options, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestIpLimitPerClient(t *testing.T) {
+	setConfig(t, func(config *Config) {
+		config.IpLimitPerSecond = 1
+		config.IpLimitBoost = 2
+	})
+	savedIps, savedLimiter := ipLimiters, limiter
+	ipLimiters = &ipLimiterStore{limiters: map[string]*ipLimiter{}}
+	limiter = rate.NewLimiter(HttpLimitPerSecons, HttpLimitPerSeconsBoost)
+	defer func() { ipLimiters, limiter = savedIps, savedLimiter }()
+
+	h := limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(remote string) int {
+		req := httptest.NewRequest(http.MethodGet, "/check", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	codes := []int{get("1.1.1.1:1000"), get("1.1.1.1:1001"), get("1.1.1.1:1002")}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != 429 {
+		t.Fatal(codes)
+	}
+	if code := get("2.2.2.2:1000"); code != 200 {
+		t.Fatal(code)
+	}
+}
+
+func TestForwardedForFromTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	setConfig(t, func(config *Config) { config.TrustedProxies = configEnv{}.envNets("TRUSTED_PROXIES") })
+
+	cases := []struct{ remote, forwarded, client string }{
+		{"10.1.1.1:3", "1.2.3.4, 10.2.2.2", "1.2.3.4"},
+		{"10.1.1.1:3", "6.6.6.6, 1.2.3.4", "1.2.3.4"},
+		{"8.8.8.8:3", "1.2.3.4", "8.8.8.8"},
+		{"192.168.1.1:1", "junk", "192.168.1.1"},
+		{"192.168.1.1:1", "", "192.168.1.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remote
+		req.Header.Set("X-Forwarded-For", c.forwarded)
+		if got := clientIp(req); got != c.client {
+			t.Error(c, got)
+		}
+	}
+}
+
+func TestBodyBuffersAreReset(t *testing.T) {
+	buf := getBodyBuffer()
+	buf.WriteString("previous body")
+	putBodyBuffer(buf)
+
+	for i := 0; i < 3; i++ {
+		if buf := getBodyBuffer(); buf.Len() != 0 {
+			t.Fatal(buf.String())
+		}
+	}
+
+	big := getBodyBuffer()
+	big.Grow(2 * bodyBufferKeepLimit)
+	putBodyBuffer(big)
+}
+
+//Buffers from the pool against a new one per check
+func BenchmarkReadBody(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 64<<10)
+	opts := CheckOptions{HashBody: true}
+	read := func(b *testing.B, buffer func() *bytes.Buffer, done func(*bytes.Buffer)) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			resp := &http.Response{StatusCode: 200, ContentLength: -1, Body: io.NopCloser(bytes.NewReader(body))}
+			buf := buffer()
+			if _, err := readBody(resp, opts, buf); err != nil {
+				b.Fatal(err)
+			}
+			done(buf)
+		}
+	}
+
+	b.Run("pool", func(b *testing.B) {
+		read(b, getBodyBuffer, putBodyBuffer)
+	})
+	b.Run("alloc", func(b *testing.B) {
+		read(b, func() *bytes.Buffer { return new(bytes.Buffer) }, func(*bytes.Buffer) {})
+	})
+}
+
+func TestBodyBufferedOnlyWhenNeeded(t *testing.T) {
+	body := strings.Repeat("x", 5000)
+	response := func() *http.Response {
+		return &http.Response{StatusCode: 200, ContentLength: -1, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	buf := new(bytes.Buffer)
+	size, err := readBody(response(), CheckOptions{}, buf)
+	if err != nil || size != 5000 || buf.Len() != 0 {
+		t.Fatal(size, buf.Len(), err)
+	}
+
+	size, err = readBody(response(), CheckOptions{HashBody: true}, buf)
+	if err != nil || size != 5000 || buf.Len() != 5000 {
+		t.Fatal(size, buf.Len(), err)
+	}
+
+	//Too big to drain for reuse, the size comes from Content-Length
+	big := &http.Response{StatusCode: 200, ContentLength: DrainLimit + 1, Body: io.NopCloser(strings.NewReader("abc"))}
+	size, err = readBody(big, CheckOptions{}, new(bytes.Buffer))
+	if err != nil || size != DrainLimit+1 {
+		t.Fatal(size, err)
+	}
+}
+
+func TestDrainedBodyReusesConnection(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 1<<20))
+	})
+
+	reused := func(drain int64) bool {
+		client := &http.Client{Transport: newTransport()}
+		defer client.CloseIdleConnections()
+
+		var second bool
+		for i := 0; i < 2; i++ {
+			var got bool
+			ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) { got = info.Reused },
+			})
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+			resp, err := client.Do(req); if err != nil {
+				t.Fatal(err)
+			}
+			closeBody(resp.Body, &Config{DrainLimit: drain})
+			second = got
+		}
+		return second
+	}
+
+	if !reused(2 << 20) {
+		t.Fatal("drained body, connection not reused")
+	}
+	if reused(0) {
+		t.Fatal("unread body, connection reused")
+	}
+}
+
+func TestBenchmarkEndpoint(t *testing.T) {
+	rec := httptest.NewRecorder()
+	benchmarkHandler(rec, httptest.NewRequest(http.MethodGet, "/benchmark?n=20", nil))
+
+	var result BenchmarkResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || result.Checks != 20 || result.Errors != 0 || result.PerSecond <= 0 {
+		t.Fatal(rec.Body.String(), err)
+	}
+
+	for _, debug := range []bool{false, true} {
+		setConfig(t, func(config *Config) { config.Debug = debug })
+		rec := httptest.NewRecorder()
+		index(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if strings.Contains(rec.Body.String(), "/benchmark") != debug {
+			t.Fatal(debug, rec.Body.String())
+		}
+	}
+}
+
+//Single check of a local server, the cost of CheckUrl itself
+func BenchmarkCheckUrl(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	b.Cleanup(srv.Close)
+	ch := make(chan UrlCheckResult, 1)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := CheckUrl(Url{path: srv.URL}, CheckOptions{}, ch, context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		<-ch
+	}
+}
+
+//Whole batches through checkHandler: decoding, queues, collector and encoding on top of the checks
+func BenchmarkCheckHandler(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, "ok")
+	}))
+	b.Cleanup(srv.Close)
+	body := batch(`"HostConcurrency":5`, paths(srv.URL, 10)...)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if rec := postCheck(body); rec.Code != 200 {
+			b.Fatal(rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestPartialResponse(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack(); if err != nil {
+			return
+		}
+		_ = conn.Close()
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if err == nil || result.ErrorKind != ErrorKindPartialResponse || result.Code != 200 || !strings.Contains(result.Message, "5 bytes") {
+		t.Fatal(result, err)
+	}
+
+	//Nothing looks into the body, one small enough to drain is still read to find the early close
+	short := serveRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\nabc")
+	result, err = checkOne(short.URL, CheckOptions{})
+	if err == nil || result.ErrorKind != ErrorKindPartialResponse || !strings.Contains(result.Message, "3 bytes") {
+		t.Fatal(result, err)
+	}
+}
+
+func TestIndexHint(t *testing.T) {
+	h := index(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var hint IndexResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &hint); err != nil || rec.Code != 200 || hint.Version != VERSION {
+		t.Fatal(rec.Code, rec.Body.String(), err)
+	}
+	if _, ok := hint.Endpoints["POST /check"]; !ok {
+		t.Fatal(hint.Endpoints)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/nothing", nil))
+	if rec.Code != 404 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte("hello"))
+		w.Header().Set("X-Checksum", "abc")
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{Trailers: []string{"X-Checksum", "X-Missing"}})
+	if err != nil || len(result.Trailers) != 1 || result.Trailers["X-Checksum"] != "abc" {
+		t.Fatal(result.Trailers, err)
+	}
+
+	result, _ = checkOne(srv.URL, CheckOptions{})
+	if result.Trailers != nil {
+		t.Fatal(result.Trailers)
+	}
+}
+
+func TestExpectUnreachable(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	result, err := checkOne(closedUrl(t), CheckOptions{ExpectUnreachable: true})
+	if err != nil || !result.Healthy || !strings.Contains(result.Message, "Unreachable as expected") {
+		t.Fatal(result, err)
+	}
+
+	result, err = checkOne(srv.URL, CheckOptions{ExpectUnreachable: true})
+	if err == nil || result.Healthy || result.ErrorKind != ErrorKindReachable {
+		t.Fatal(result, err)
+	}
+
+	//The server answered: a TLS error or a cut body is reachable
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(tlsSrv.Close)
+	short := serveRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nabc")
+	for _, path := range []string{tlsSrv.URL, short.URL} {
+		if result, err = checkOne(path, CheckOptions{ExpectUnreachable: true}); err == nil || result.ErrorKind != ErrorKindReachable {
+			t.Fatal(path, result, err)
+		}
+	}
+
+	//Nothing learned about the url when the batch ended first
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch := make(chan UrlCheckResult, 1)
+	_ = CheckUrl(Url{path: closedUrl(t)}, CheckOptions{ExpectUnreachable: true}, ch, ctx)
+	if result := <-ch; result.Healthy || result.ErrorKind != ErrorKindClientCanceled {
+		t.Fatal(result)
+	}
+}
+
+func TestPunycodeHost(t *testing.T) {
+	path, idn, ascii := punycodeUrl("https://münchen.de:8080/a?b=1")
+	if path != "https://xn--mnchen-3ya.de:8080/a?b=1" || idn != "münchen.de" || ascii != "xn--mnchen-3ya.de" {
+		t.Fatal(path, idn, ascii)
+	}
+
+	path, idn, ascii = punycodeUrl("https://example.com/")
+	if path != "https://example.com/" || idn != "" || ascii != "" {
+		t.Fatal(path, idn, ascii)
+	}
+}
+
+func TestDialLimitPerFamily(t *testing.T) {
+	setConfig(t, func(config *Config) {
+		config.DialLimitV4 = 1
+		config.DialLimitV6 = 2
+	})
+	d := newDialer()
+	if cap(d.v4) != 1 || cap(d.v6) != 2 {
+		t.Fatal(cap(d.v4), cap(d.v6))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0"); if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	//The ipv4 slot is taken, ipv4 dials wait while ipv6 ones don't
+	d.v4 <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := d.dialIp(ctx, "tcp", net.ParseIP("127.0.0.1"), port); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if conn, err := d.dialIp(context.Background(), "tcp", net.ParseIP("::1"), port); err == nil {
+		_ = conn.Close()
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Fatal("ipv6 dial waited for the ipv4 slot")
+	}
+
+	<-d.v4
+	conn, err := d.dialIp(context.Background(), "tcp", net.ParseIP("127.0.0.1"), port); if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestSampleLatencyStats(t *testing.T) {
+	stats := latencyStats([]float64{1, 2, 3, 4})
+	if stats.Min != 1 || stats.Max != 4 || stats.Mean != 2.5 || math.Abs(stats.StdDev-math.Sqrt(1.25)) > 1e-9 {
+		t.Fatal(*stats)
+	}
+
+	var n int32
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.AddInt32(&n, 1)-1) * 50 * time.Millisecond)
+	})
+	result, err := checkOne(srv.URL, CheckOptions{Samples: 3})
+	if err != nil || result.Latency == nil || n != 3 {
+		t.Fatal(result, err)
+	}
+	if latency := result.Latency; latency.Max-latency.Min < 0.09 || latency.StdDev <= 0 || latency.Mean <= latency.Min {
+		t.Fatal(*latency)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if err != nil || result.RemoteIP != "127.0.0.1" {
+		t.Fatal(result, err)
+	}
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	srv := serveTLS(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if err == nil || result.ErrorKind != ErrorKindTlsUntrusted || !strings.Contains(result.Message, "self-signed") {
+		t.Fatal(result, err)
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	saved := bandwidth
+	bandwidth = rate.NewLimiter(200000, 20000)
+	defer func() { bandwidth = saved }()
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 100000))
+	})
+
+	start := time.Now()
+	result, err := checkOne(srv.URL, CheckOptions{HashBody: true, TimeoutMs: 5000})
+	//80kb over the burst at 200kb/s
+	if elapsed := time.Since(start); err != nil || elapsed < 350*time.Millisecond {
+		t.Fatal(elapsed, result, err)
+	}
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+			}
+		}
+	})
+
+	start := time.Now()
+	rec := postCheck(batch("", otherHost(srv)+"/fast", srv.URL+"/slow"), "X-Deadline", "0.2")
+	response := decodeResponse(t, rec)
+	if rec.Code != 200 || !response.Partial || time.Since(start) > 700*time.Millisecond {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if response.Urls[0].Code != 200 || response.Urls[1].ErrorKind != ErrorKindBatchTimeout {
+		t.Fatal(rec.Body.String())
+	}
+
+	deadline := time.Now().Add(time.Minute).Format(time.RFC3339)
+	if rec := postCheck(batch("", srv.URL+"/fast"), "X-Deadline", deadline); rec.Code != 200 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if rec := postCheck(batch("", srv.URL+"/fast"), "X-Deadline", "soon"); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestHostConcurrencyFromHostCount(t *testing.T) {
+	cases := []struct {
+		paths   []string
+		perHost int
+	}{
+		{[]string{"http://a/1", "http://a/2", "http://a/3"}, 1},
+		{[]string{"http://a/1", "http://b/2", "http://c/3"}, LimitOutgoingConnections},
+		{[]string{"http://a/1", "http://a/2", "http://c/3", "http://d"}, 2},
+		{[]string{"http://a/1"}, 1},
+	}
+	for _, c := range cases {
+		queues, perHost := hostLimits(c.paths, 0)
+		if perHost != c.perHost || cap(queues["a"]) != c.perHost {
+			t.Error(c.paths, perHost)
+		}
+	}
+
+	if _, perHost := hostLimits([]string{"http://a/1", "http://a/2"}, 2); perHost != 2 {
+		t.Fatal(perHost)
+	}
+	if _, perHost := hostLimits([]string{"http://a/1"}, 99); perHost != LimitOutgoingConnections {
+		t.Fatal(perHost)
+	}
+}
+
+//Good staple of the test certificate, signed by itself
+func stapleOCSP(t *testing.T, srv *httptest.Server, thisUpdate time.Time) {
+	leaf := srv.Certificate()
+	staple, err := ocsp.CreateResponse(leaf, leaf, ocsp.Response{
+		Status: ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate: thisUpdate,
+		NextUpdate: thisUpdate.Add(24 * time.Hour),
+	}, srv.TLS.Certificates[0].PrivateKey.(crypto.Signer)); if err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS.Certificates[0].OCSPStaple = staple
+	transport.CloseIdleConnections()
+}
+
+func TestOCSPStaple(t *testing.T) {
+	srv := serveTLS(t, func(w http.ResponseWriter, r *http.Request) {})
+	trustTestCert(t, srv)
+
+	result, err := checkOne(srv.URL, CheckOptions{ReportOCSP: true})
+	if err != nil || result.OCSPStatus != "none" {
+		t.Fatal(result.OCSPStatus, err)
+	}
+
+	stapleOCSP(t, srv, time.Now().Add(-time.Hour))
+	result, err = checkOne(srv.URL, CheckOptions{ReportOCSP: true})
+	if err != nil || result.OCSPStatus != "good" {
+		t.Fatal(result.OCSPStatus, err)
+	}
+	if result, _ = checkOne(srv.URL, CheckOptions{}); result.OCSPStatus != "" {
+		t.Fatal(result.OCSPStatus)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	saved := ready.Load()
+	defer ready.Store(saved)
+
+	status := func() (int, string) {
+		rec := httptest.NewRecorder()
+		readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	ready.Store(false)
+	if code, _ := status(); code != 503 {
+		t.Fatal(code)
+	}
+	ready.Store(true)
+	if code, body := status(); code != 200 || body != "ok" {
+		t.Fatal(code, body)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+			case "/a":
+				http.Redirect(w, r, "/b", http.StatusFound)
+			case "/b":
+				http.Redirect(w, r, "/a", http.StatusFound)
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/a", CheckOptions{})
+	if err == nil || result.ErrorKind != ErrorKindRedirectLoop || !strings.Contains(result.Message, "/a") {
+		t.Fatal(result, err)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	var peak peakCounter
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		peak.enter()
+		defer peak.leave()
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	response := decodeResponse(t, postCheck(batch(`"HostConcurrency":3`, paths(srv.URL, 3)...)))
+	if response.MaxInFlight != 3 || peak.peak != 3 || response.HostConcurrency != 3 || response.Concurrency != LimitOutgoingConnections {
+		t.Fatal(response.MaxInFlight, peak.peak, response.HostConcurrency)
+	}
+
+	response = decodeResponse(t, postCheck(batch("", paths(srv.URL, 3)...)))
+	if response.MaxInFlight != 1 || response.HostConcurrency != 1 {
+		t.Fatal(response.MaxInFlight, response.HostConcurrency)
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 1000))
+	})
+
+	for _, path := range []string{"/length", "/chunked"} {
+		result, err := checkOne(srv.URL+path, CheckOptions{MaxBytes: 100})
+		if err == nil || result.ErrorKind != ErrorKindByteBudget || result.Code != 200 {
+			t.Fatal(path, result, err)
+		}
+	}
+
+	if _, err := checkOne(srv.URL+"/chunked", CheckOptions{MaxBytes: 1000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{HashBody: true})
+	if err != nil || result.Code != 204 || !strings.Contains(result.Message, "No content (No Content)") {
+		t.Fatal(result, err)
+	}
+}
+
+func TestRedirectsUnhealthy(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		}
+	})
+	follow := false
+
+	result, err := checkOne(srv.URL+"/old", CheckOptions{RedirectsUnhealthy: true, FollowRedirects: &follow})
+	if err == nil || result.ErrorKind != ErrorKindRedirect || result.Code != 301 || !strings.Contains(result.Message, "/new") {
+		t.Fatal(result, err)
+	}
+	if _, err := checkOne(srv.URL+"/new", CheckOptions{RedirectsUnhealthy: true, FollowRedirects: &follow}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkOne(srv.URL+"/old", CheckOptions{FollowRedirects: &follow}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailureAlerts(t *testing.T) {
+	posted := make(chan map[string]string, 10)
+	hook := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		posted <- payload
+	})
+	setConfig(t, func(config *Config) { config.AlertWebhook = hook.URL })
+	saved := alerts
+	alerts = &alerter{sent: map[string]time.Time{}, limiter: rate.NewLimiter(rate.Inf, 1)}
+	defer func() { alerts = saved }()
+
+	down := closedUrl(t)
+	for i := 0; i < 2; i++ {
+		if rec := postCheck(batch("", down)); rec.Code != 400 {
+			t.Fatal(rec.Code)
+		}
+	}
+
+	select {
+		case payload := <-posted:
+			if !strings.HasPrefix(payload["text"], "url check failed") || !strings.Contains(payload["text"], down) {
+				t.Fatal(payload)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no alert")
+	}
+	select {
+		case payload := <-posted:
+			t.Fatal("same failure alerted twice", payload)
+		case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestCheckSlotsAcrossBatches(t *testing.T) {
+	saved := checkSlots
+	checkSlots = newSlots(1)
+	defer func() { checkSlots = saved }()
+	var peak peakCounter
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		peak.enter()
+		defer peak.leave()
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := postCheck(batch("", srv.URL+"/a", otherHost(srv)+"/b")); rec.Code != 200 {
+				t.Error(rec.Code, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if peak.peak != 1 {
+		t.Fatal(peak.peak)
+	}
+}
+
+type slowResolver struct {
+	delay time.Duration
+}
+
+func (r slowResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	select {
+		case <-time.After(r.delay):
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+	}
+}
+
+func TestDNSTimeout(t *testing.T) {
+	config := setConfig(t, func(config *Config) { config.DNSTimeout = 50 * time.Millisecond })
+	d := newDialer()
+	d.resolver = slowResolver{delay: time.Second}
+
+	_, err := d.lookup(withConfig(context.Background(), config), "slow.test")
+	var dnsTimeout *dnsTimeoutError
+	if !errors.As(err, &dnsTimeout) || dnsTimeout.host != "slow.test" {
+		t.Fatal(err)
+	}
+	if kind, _ := transportErrorKind(context.Background(), fmt.Errorf("dial: %w", err)); kind != ErrorKindDNSTimeout {
+		t.Fatal(kind)
+	}
+
+	d.resolver = slowResolver{delay: 10 * time.Millisecond}
+	if ips, err := d.lookup(withConfig(context.Background(), config), "fast.test"); err != nil || len(ips) != 1 {
+		t.Fatal(ips, err)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	for attempt := 0; attempt < 6; attempt++ {
+		backoff := RetryBackoff << uint(attempt)
+		if backoff > RetryBackoffMax {
+			backoff = RetryBackoffMax
+		}
+		if delay := retryDelay(attempt, "none"); delay != backoff {
+			t.Fatal(attempt, delay)
+		}
+		for i := 0; i < 20; i++ {
+			if delay := retryDelay(attempt, "equal"); delay < backoff/2 || delay >= backoff {
+				t.Fatal(attempt, delay)
+			}
+			if delay := retryDelay(attempt, "full"); delay < 0 || delay >= backoff {
+				t.Fatal(attempt, delay)
+			}
+		}
+	}
+}
+
+func TestPrometheusFormat(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := postCheck(batch(`"ErrorBudget":1`, srv.URL, closedUrl(t), srv.URL), "Accept", "text/plain; version=0.0.4")
+	body := rec.Body.String()
+	if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatal(rec.Code, rec.Header())
+	}
+	for _, line := range []string{
+		"# TYPE url_check_up gauge",
+		`url_check_up{url="` + srv.URL + `",index="0"} 1`,
+		`url_check_status_code{url="` + srv.URL + `",index="0"} 200`,
+		`url_check_status_code{url="` + srv.URL + `",index="2"} 200`,
+		"url_check_status_code{url=\"http://127.0.0.1:", `index="1"} 10`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatal(line, body)
+		}
+	}
+	if prometheusLabel("a\"b\\c\nd") != `a\"b\\c\nd` {
+		t.Fatal(prometheusLabel("a\"b\\c\nd"))
+	}
+}
+
+func TestStreamEndsAsArrayAtDeadline(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+				case <-time.After(time.Second):
+				case <-r.Context().Done():
+			}
+		}
+	})
+
+	rec := postCheck(batch(`"Stream":true`, srv.URL+"/slow", otherHost(srv)+"/fast"), "X-Deadline", "0.2")
+	var results []UrlCheckResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatal(rec.Body.String(), err)
+	}
+	//Completion order, the fast url comes first
+	if results[0].Index != 1 || !results[0].Healthy || results[1].ErrorKind != ErrorKindBatchTimeout {
+		t.Fatal(rec.Body.String())
+	}
+}
+
+func TestSeededShuffle(t *testing.T) {
+	saved := shuffleRand
+	defer func() { shuffleRand = saved }()
+
+	shuffleRand = newLockedRand(7)
+	order := scheduleOrder(8, true)
+	if expected := newLockedRand(7).Perm(8); fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatal(order, expected)
+	}
+	if order := scheduleOrder(3, false); fmt.Sprint(order) != "[0 1 2]" {
+		t.Fatal(order)
+	}
+
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	response := decodeResponse(t, postCheck(batch(`"Shuffle":true`, paths(srv.URL, 5)...)))
+	for i, result := range response.Urls {
+		if result.Index != i || !strings.HasSuffix(result.Message, fmt.Sprintf("/%d code: 200", i)) {
+			t.Fatal(i, result)
+		}
+	}
+}
+
+func TestHostLimit(t *testing.T) {
+	setConfig(t, func(config *Config) { config.HostLimit = 1 })
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	if rec := postCheck(batch("", srv.URL+"/a", srv.URL+"/b")); rec.Code != 200 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	rec := postCheck(batch("", srv.URL, otherHost(srv)))
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "to many hosts") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	path := withQueryParams("http://a.test/p?x=1&cb=old", map[string]string{"cb": "new", "v": "2"})
+	u, err := url.Parse(path); if err != nil {
+		t.Fatal(err)
+	}
+	if query := u.Query(); query.Get("x") != "1" || query.Get("cb") != "new" || query.Get("v") != "2" || u.Path != "/p" {
+		t.Fatal(path)
+	}
+
+	var got url.Values
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) { got = r.URL.Query() })
+	if _, err := checkOne(srv.URL+"/?x=1", CheckOptions{QueryParams: map[string]string{"cb": "1"}}); err != nil || got.Get("cb") != "1" || got.Get("x") != "1" {
+		t.Fatal(got, err)
+	}
+}
+
+func TestTimeoutKinds(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+		}
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{TimeoutMs: 100})
+	if err == nil || result.ErrorKind != ErrorKindUrlTimeout {
+		t.Fatal(result, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	ch := make(chan UrlCheckResult, 1)
+	_ = CheckUrl(Url{path: srv.URL}, CheckOptions{}, ch, ctx)
+	if result := <-ch; result.ErrorKind != ErrorKindClientCanceled {
+		t.Fatal(result)
+	}
+
+	ctx, cancelCause := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { cancelCause(errors.New("other url failed")) })
+	_ = CheckUrl(Url{path: srv.URL}, CheckOptions{}, ch, ctx)
+	if result := <-ch; result.ErrorKind != ErrorKindCanceled {
+		t.Fatal(result)
+	}
+}
+
+func TestResultHooks(t *testing.T) {
+	useHooks(t,
+		func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+			result.Annotations = map[string]interface{}{"team": "web"}
+			return result, err
+		},
+		func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+			if strings.HasSuffix(url.path, "/vetoed") {
+				return result, fmt.Errorf("vetoed %s", url.path)
+			}
+			return result, err
+		})
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	result, err := checkOne(srv.URL+"/fine", CheckOptions{})
+	if err != nil || !result.Healthy || result.Annotations["team"] != "web" {
+		t.Fatal(result, err)
+	}
+	result, err = checkOne(srv.URL+"/vetoed", CheckOptions{})
+	if err == nil || result.Healthy || result.Code != 200 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	rec := postCheck(batch(`"ErrorBudget":5,"MaxResponseBytes":900`, srv.URL+"/0", srv.URL+"/1", down, srv.URL+"/3"))
+	response := decodeResponse(t, rec)
+	if rec.Body.Len() > 900 || !response.Truncated || len(response.Urls) == 0 || len(response.Urls) == 4 {
+		t.Fatal(rec.Body.Len(), rec.Body.String())
+	}
+	if response.Urls[0].Index != 2 || response.Urls[0].Healthy {
+		t.Fatal("failure not kept first", rec.Body.String())
+	}
+
+	response = decodeResponse(t, postCheck(batch(`"ErrorBudget":5,"MaxResponseBytes":100000`, srv.URL+"/0", down)))
+	if response.Truncated || len(response.Urls) != 2 {
+		t.Fatal(response)
+	}
+
+	//The other layouts are limited too
+	urls := append(paths(srv.URL, 8), down)
+	for _, layout := range []string{`"MapByUrl":true`, `"GroupByHost":true`, `"Collapse":true`} {
+		full := postCheck(batch(`"ErrorBudget":5,`+layout, urls...))
+		rec := postCheck(batch(`"ErrorBudget":5,"MaxResponseBytes":`+strconv.Itoa(full.Body.Len()-60)+","+layout, urls...))
+		response := decodeResponse(t, rec)
+		if rec.Body.Len() >= full.Body.Len() || !response.Truncated || response.Urls != nil {
+			t.Fatal(layout, rec.Body.Len(), full.Body.Len(), rec.Body.String())
+		}
+	}
+	rec = postCheck(batch(`"ErrorBudget":5,"MaxResponseBytes":1500,"MapByUrl":true`, urls...))
+	if response := decodeResponse(t, rec); rec.Body.Len() > 1500 || len(response.ByUrl) == 0 || response.ByUrl[down].Healthy {
+		t.Fatal(rec.Body.Len(), rec.Body.String())
+	}
+}
+
+func TestEchoRequest(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	u, _ := url.Parse(srv.URL)
+
+	secret := "http://user:hunter2@" + u.Host + "/?token=abc&page=2"
+	response := decodeResponse(t, postCheck(batch(`"EchoRequest":true,"Retries":9,"QueryParams":{"api_key":"k1","lang":"en"}`, secret)))
+	echo := response.Request
+	if echo == nil || len(echo.Urls) != 1 {
+		t.Fatal(response)
+	}
+	if strings.Contains(echo.Urls[0], "hunter2") || strings.Contains(echo.Urls[0], "abc") || !strings.Contains(echo.Urls[0], "page=2") {
+		t.Fatal(echo.Urls[0])
+	}
+	if echo.QueryParams["api_key"] != "REDACTED" || echo.QueryParams["lang"] != "en" {
+		t.Fatal(echo.QueryParams)
+	}
+	if echo.Retries != RetryLimit || echo.Samples != 1 || echo.RetryJitter != "full" {
+		t.Fatal(echo.Retries, echo.Samples, echo.RetryJitter)
+	}
+
+	response = decodeResponse(t, postCheck(batch(`"EchoRequest":true,"Method":"POST","Body":"{\"password\":\"pw1\"}","Baseline":{"`+secret+`":200}`, secret)))
+	echo = response.Request
+	if echo.Body != "REDACTED" || len(echo.Baseline) != 1 {
+		t.Fatal(echo.Body, echo.Baseline)
+	}
+	for path := range echo.Baseline {
+		if strings.Contains(path, "hunter2") || strings.Contains(path, "abc") {
+			t.Fatal(path)
+		}
+	}
+
+	setConfig(t, func(config *Config) { config.SourcePrivate = true })
+	source := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `["%s"]`, srv.URL)
+	})
+	sourceHost, _ := url.Parse(source.URL)
+	response = decodeResponse(t, postCheck(`{"EchoRequest":true,"UrlsSource":"http://user:hunter2@`+sourceHost.Host+`/?token=abc&page=2"}`))
+	echo = response.Request
+	if len(response.Urls) != 1 || strings.Contains(echo.UrlsSource, "hunter2") || strings.Contains(echo.UrlsSource, "abc") || !strings.Contains(echo.UrlsSource, "page=2") {
+		t.Fatal(response.Urls, echo.UrlsSource)
+	}
+}
+
+func TestShutdownDrains(t *testing.T) {
+	setConfig(t, func(config *Config) { config.DrainPeriod = 150 * time.Millisecond })
+	saved := ready.Load()
+	defer ready.Store(saved)
+	ready.Store(true)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0"); if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readyz", readyzHandler)
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(ln) }()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- shutdown(server) }()
+
+	time.Sleep(50 * time.Millisecond)
+	resp, err := http.Get("http://" + ln.Addr().String() + "/readyz"); if err != nil {
+		t.Fatal("not serving while draining", err)
+	}
+	closeBody(resp.Body, currentConfig())
+	if resp.StatusCode != 503 {
+		t.Fatal(resp.StatusCode)
+	}
+
+	if err := <-done; err != nil || time.Since(start) < 150*time.Millisecond {
+		t.Fatal(time.Since(start), err)
+	}
+}
+
+func TestScheduledStatus(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	paths := []string{srv.URL + "/up", srv.URL + "/down"}
+	setConfig(t, func(config *Config) { config.ScheduleUrls = paths })
+	saved := schedule
+	schedule = &scheduler{latest: map[string]ScheduledResult{}}
+	defer func() { schedule = saved }()
+
+	schedule.checkAll(context.Background(), paths)
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status struct {
+		Urls []struct {
+			Code      int       `json:"code"`
+			CheckedAt time.Time `json:"checked_at"`
+		} `json:"urls"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil || len(status.Urls) != 2 {
+		t.Fatal(rec.Body.String(), err)
+	}
+	if status.Urls[0].Code != 200 || status.Urls[1].Code != 503 || status.Urls[0].CheckedAt.IsZero() {
+		t.Fatal(rec.Body.String())
+	}
+}
+
+func TestLargeRedirectBodyNotRead(t *testing.T) {
+	var written int64
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/final" {
+			return
+		}
+		w.Header().Set("Location", "/final")
+		w.WriteHeader(http.StatusFound)
+		chunk := bytes.Repeat([]byte("x"), 64<<10)
+		for i := 0; i < 160; i++ {
+			n, err := w.Write(chunk)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/hop", CheckOptions{})
+	if err != nil || result.RedirectCount != 1 || result.Code != 200 {
+		t.Fatal(result, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&written); n >= 160*64<<10 {
+		t.Fatal("whole hop body read", n)
+	}
+}
+
+func TestDiscardBody(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hop" {
+			http.Redirect(w, r, "/final", http.StatusFound)
+			return
+		}
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 2<<20))
+	})
+
+	response := decodeResponse(t, postCheck(batch(`"DiscardBody":true`, srv.URL+"/hop")))
+	result := response.Urls[0]
+	if !result.Healthy || result.Code != 200 || result.RedirectCount != 1 || result.FinalUrl != srv.URL+"/final" || !strings.Contains(result.Message, "2048kb") {
+		t.Fatal(result)
+	}
+
+	//Past DrainLimit the size is taken from Content-Length unless the body is discarded
+	setConfig(t, func(config *Config) { config.DrainLimit = 2 })
+	short := serveRaw(t, "HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\nabc")
+	if result, err := checkOne(short.URL, CheckOptions{}); err != nil || !result.Healthy {
+		t.Fatal(result, err)
+	}
+	result, err := checkOne(short.URL, CheckOptions{DiscardBody: true})
+	if err == nil || result.ErrorKind != ErrorKindPartialResponse || !strings.Contains(result.Message, "3 bytes") {
+		t.Fatal(result, err)
+	}
+
+	for _, options := range []string{`"DiscardBody":true,"HashBody":true`, `"DiscardBody":true,"Method":"POST"`, `"DiscardBody":true,"FollowRedirects":false`} {
+		if rec := postCheck(batch(options, srv.URL)); rec.Code != 400 {
+			t.Error(options, rec.Code)
+		}
+	}
+}
+
+func TestRequireHSTS(t *testing.T) {
+	srv := serveTLS(t, func(w http.ResponseWriter, r *http.Request) {
+		if age := r.URL.Query().Get("age"); age != "" {
+			w.Header().Set("Strict-Transport-Security", "max-age="+age+"; includeSubDomains")
+		}
+	})
+	trustTestCert(t, srv)
+
+	cases := map[string]string{
+		"/": "missing",
+		"/?age=60": "max-age 60 < 15552000",
+		"/?age=x": "bad max-age",
+		"/?age=31536000": "",
+	}
+	for path, problem := range cases {
+		result, err := checkOne(srv.URL+path, CheckOptions{RequireHSTS: true})
+		if problem == "" {
+			if err != nil {
+				t.Error(path, result)
+			}
+			continue
+		}
+		if err == nil || result.ErrorKind != ErrorKindHSTS || !strings.Contains(result.Message, problem) {
+			t.Error(path, result)
+		}
+	}
+
+	if problem := hstsProblem(&http.Response{Header: http.Header{}}, HSTSMinAge); problem != "needs https" {
+		t.Fatal(problem)
+	}
+}
+
+func TestPanicFailsOnlyItsUrl(t *testing.T) {
+	useHooks(t, func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+		if strings.HasSuffix(url.path, "/boom") {
+			panic("hook bug")
+		}
+		return result, err
+	})
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	response := decodeResponse(t, postCheck(batch(`"ErrorBudget":1`, srv.URL+"/boom", otherHost(srv)+"/fine")))
+	if response.Urls[0].ErrorKind != ErrorKindPanic || response.Urls[0].Healthy || !response.Urls[1].Healthy {
+		t.Fatal(response.Urls)
+	}
+}
+
+func fakeResults(codes ...int) []UrlCheckResult {
+	results := make([]UrlCheckResult, len(codes))
+	for i, code := range codes {
+		results[i] = UrlCheckResult{
+			Url: &Url{path: fmt.Sprintf("http://%c.test/", 'z'-i), index: i},
+			Code: code,
+			Healthy: code < 500,
+			Time: float64(i%3) / 10,
+			Index: i,
+		}
+	}
+	return results
+}
+
+func TestSortBy(t *testing.T) {
+	results := fakeResults(200, 503, 404, 500, 200)
+	order := func(sortBy string) string {
+		var indexes []int
+		for _, result := range prepareResponse(CheckRequest{SortBy: sortBy}, CheckResponse{Urls: results}).Urls {
+			indexes = append(indexes, result.Index)
+		}
+		return fmt.Sprint(indexes)
+	}
+
+	cases := map[string]string{
+		"": "[0 1 2 3 4]",
+		"status": "[1 3 2 0 4]",
+		"latency_desc": "[2 1 4 0 3]",
+		"url": "[4 3 2 1 0]",
+	}
+	for sortBy, expected := range cases {
+		if got := order(sortBy); got != expected {
+			t.Error(sortBy, got)
+		}
+	}
+	if rec := postCheck(batch(`"SortBy":"size"`, "http://a.test")); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestIndexesKeptAfterSort(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	response := decodeResponse(t, postCheck(batch(`"SortBy":"status","Shuffle":true`, paths(srv.URL, 3)...)))
+	if response.Urls[0].Index != 1 || response.Urls[0].Code != 404 {
+		t.Fatal(response.Urls)
+	}
+	for _, result := range response.Urls {
+		if !strings.Contains(result.Message, fmt.Sprintf("/%d code", result.Index)) {
+			t.Fatal(result)
+		}
+	}
+}
+
+func TestTimeToFirstByte(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("rest"))
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if err != nil || result.TTFB < 0.1 || result.Time < result.TTFB+0.09 {
+		t.Fatal(result.TTFB, result.Time, err)
+	}
+}
+
+func TestTooManyOpenFiles(t *testing.T) {
+	err := fmt.Errorf("dial: %w", &os.SyscallError{Syscall: "socket", Err: syscall.EMFILE})
+	if kind, detail := transportErrorKind(context.Background(), err); kind != ErrorKindTooManyFiles || !strings.Contains(detail, "ulimit") {
+		t.Fatal(kind, detail)
+	}
+
+	d := newDialer()
+	d.fdPause.Store(time.Now().Add(100 * time.Millisecond).UnixNano())
+	start := time.Now()
+	if err := d.waitFds(context.Background()); err != nil || time.Since(start) < 90*time.Millisecond {
+		t.Fatal(time.Since(start), err)
+	}
+	if err := d.waitFds(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpectRedirectTo(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		}
+	})
+
+	for _, target := range []string{"/new", srv.URL + "/new"} {
+		result, err := checkOne(srv.URL+"/old", CheckOptions{ExpectRedirectTo: target})
+		if err != nil || result.Location != "/new" || result.Code != 301 {
+			t.Fatal(target, result, err)
+		}
+	}
+	for _, path := range []string{"/old", "/new"} {
+		result, err := checkOne(srv.URL+path, CheckOptions{ExpectRedirectTo: "/other"})
+		if err == nil || result.ErrorKind != ErrorKindRedirectTarget {
+			t.Fatal(path, result, err)
+		}
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(closedUrl(t), "http://"))
+	dial := func(retries int) time.Duration {
+		setConfig(t, func(config *Config) { config.DialRetries = retries })
+		start := time.Now()
+		if _, err := newDialer().dialIp(context.Background(), "tcp", net.ParseIP("127.0.0.1"), port); err == nil {
+			t.Fatal("dialed a closed port")
+		}
+		return time.Since(start)
+	}
+
+	if elapsed := dial(0); elapsed >= DialRetryDelay {
+		t.Fatal(elapsed)
+	}
+	if elapsed := dial(2); elapsed < 2*DialRetryDelay {
+		t.Fatal(elapsed)
+	}
+}
+
+func TestCacheStatus(t *testing.T) {
+	cases := []struct {
+		header, value, status string
+	}{
+		{"CF-Cache-Status", "HIT", "hit"},
+		{"CF-Cache-Status", "DYNAMIC", "miss"},
+		{"X-Cache-Status", "STALE", "stale"},
+		{"X-Cache", "Hit from cloudfront", "hit"},
+		{"X-Cache", "HIT, MISS", "miss"},
+		{"Age", "30", "hit"},
+		{"Age", "0", ""},
+		{"Server", "nginx", ""},
+	}
+	for _, c := range cases {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set(c.header, c.value)
+		if status := cacheStatus(resp); status != c.status {
+			t.Error(c, status)
+		}
+	}
+}
+
+//Raw HTTP/1.1 response written to the connection
+func serveRaw(t *testing.T, response string) *httptest.Server {
+	return serve(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack(); if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte(response))
+	})
+}
+
+func TestStatusText(t *testing.T) {
+	custom := serveRaw(t, "HTTP/1.1 200 Fine Thanks\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	result, err := checkOne(custom.URL, CheckOptions{})
+	if err != nil || result.StatusText != "Fine Thanks" {
+		t.Fatal(result.StatusText, err)
+	}
+
+	bare := serveRaw(t, "HTTP/1.1 404\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	if result, _ = checkOne(bare.URL, CheckOptions{}); result.StatusText != "Not Found" {
+		t.Fatal(result.StatusText)
+	}
+}
+
+func TestCanceledBatchReturns(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(batch(`"HostConcurrency":1`, paths(srv.URL, 10)...))).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	done := make(chan struct{})
+	go func() {
+		checkHandler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+		case <-done:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("handler blocked after the client left")
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	baseline := fmt.Sprintf(`"Baseline":{"%s/same":200,"%s/moved":200}`, srv.URL, srv.URL)
+	response := decodeResponse(t, postCheck(batch(baseline, srv.URL+"/same", srv.URL+"/moved", srv.URL+"/new")))
+	if response.Urls[0].Changed || !response.Urls[1].Changed || response.Urls[2].Changed {
+		t.Fatal(response.Urls)
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	rec := postCheck(batch(`"ErrorBudget":1`, srv.URL, down), "Accept", "application/vnd.junit+xml")
+	var suite JUnitSuite
+	if err := xml.Unmarshal(rec.Body.Bytes(), &suite); err != nil || rec.Header().Get("Content-Type") != "application/vnd.junit+xml" {
+		t.Fatal(rec.Body.String(), err)
+	}
+	if suite.Tests != 2 || suite.Failures != 1 || suite.Cases[0].Failure != nil || suite.Cases[1].Name != down || suite.Cases[1].Failure == nil {
+		t.Fatal(rec.Body.String())
+	}
+}
+
+func TestHTTPSOnlyRedirects(t *testing.T) {
+	plain := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	srv := serveTLS(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			http.Redirect(w, r, plain.URL, http.StatusFound)
+		}
+	})
+	trustTestCert(t, srv)
+
+	result, err := checkOne(srv.URL+"/down", CheckOptions{HTTPSOnlyRedirects: true})
+	if err == nil || result.ErrorKind != ErrorKindDowngrade {
+		t.Fatal(result, err)
+	}
+	if _, err := checkOne(srv.URL+"/down", CheckOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	setConfig(t, func(config *Config) { config.TCPKeepAlive = 7 * time.Second })
+	if d := newDialer(); d.dialer.KeepAlive != 7*time.Second {
+		t.Fatal(d.dialer.KeepAlive)
+	}
+}
+
+func TestClientCancelStopsOutbound(t *testing.T) {
+	stopped := make(chan struct{})
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				close(stopped)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(batch("", srv.URL))).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	rec := httptest.NewRecorder()
+	checkHandler(rec, req)
+
+	select {
+		case <-stopped:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("outbound request kept running")
+	}
+	if !strings.Contains(rec.Body.String(), CauseClientDisconnect) {
+		t.Fatal(rec.Body.String())
+	}
+}
+
+func TestResultLimit(t *testing.T) {
+	results := fakeResults(200, 200)
+	results[1].BodyLines = []string{strings.Repeat("x", 2000)}
+	results[1].Trailers = map[string]string{"X": strings.Repeat("y", 2000)}
+
+	limited := limitResults(results, 400)
+	if limited[0].Truncated || len(limited[0].Message) != len(results[0].Message) {
+		t.Fatal(limited[0])
+	}
+	encoded, _ := json.Marshal(limited[1])
+	if !limited[1].Truncated || limited[1].BodyLines != nil || limited[1].Trailers != nil || len(encoded) > 400 {
+		t.Fatal(string(encoded))
+	}
+	if results[1].BodyLines == nil {
+		t.Fatal("input changed")
+	}
+
+	results[0].Message = strings.Repeat("m", 1000)
+	encoded, _ = json.Marshal(limitResults(results, 400)[0])
+	if len(encoded) > 400 {
+		t.Fatal(len(encoded))
+	}
+}
+
+func TestRegions(t *testing.T) {
+	eu := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	us := serve(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) })
+	euProxy, _ := url.Parse(eu.URL)
+	usProxy, _ := url.Parse(us.URL)
+	setConfig(t, func(config *Config) { config.RegionProxies = map[string]*url.URL{"eu": euProxy, "us": usProxy} })
+	saved := regionTransports
+	regionTransports = newRegionTransports()
+	defer func() { regionTransports = saved }()
+	useHooks(t, func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+		if err == nil && result.Code >= 500 {
+			err = fmt.Errorf("code %d", result.Code)
+		}
+		return result, err
+	})
+
+	result, err := checkOne("http://example.invalid/", CheckOptions{Regions: []string{"eu", "us"}})
+	if err == nil || result.Region != "us" || len(result.Regions) != 2 || result.Regions["eu"].Code != 200 || !result.Regions["eu"].Healthy {
+		t.Fatal(result, err)
+	}
+
+	if rec := postCheck(batch(`"Regions":["mars"]`, "http://example.invalid/")); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestWarningsKeepHealth(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/plain", CheckOptions{WarnOn: []string{"no_cache_control"}})
+	if err != nil || !result.Healthy || len(result.Warnings) != 1 || result.Warnings[0] != "missing Cache-Control" || result.Degraded {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/cached", CheckOptions{WarnOn: []string{"no_cache_control"}}); result.Warnings != nil {
+		t.Fatal(result.Warnings)
+	}
+	if rec := postCheck(batch(`"WarnOn":["bad_vibes"]`, srv.URL)); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	rec := postCheck(`{"url":["http://a.test"]}`)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), `unknown field "url"`) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestFieldNamesIgnoreCase(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("x")) })
+
+	for _, body := range []string{`{"urls":["%s"],"hashbody":true}`, `{"Urls":["%s"],"HashBody":true}`, `{"URLS":["%s"],"HASHBODY":true}`} {
+		response := decodeResponse(t, postCheck(fmt.Sprintf(body, srv.URL)))
+		if len(response.Urls) != 1 || response.Urls[0].BodyHash == "" {
+			t.Fatal(body, response)
+		}
+	}
+}
+
+func TestCompareMethods(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/nohead" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/nohead", CheckOptions{CompareMethods: true})
+	if err != nil || result.Head == nil || result.Head.Code != 405 || !result.MethodMismatch || result.Code != 200 {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/both", CheckOptions{CompareMethods: true}); result.MethodMismatch || result.Head.Code != 200 {
+		t.Fatal(result)
+	}
+}
+
+func TestTimeBudget(t *testing.T) {
+	if newTimeBudget(0, 5, MinTimeout) != nil {
+		t.Fatal("budget without seconds")
+	}
+
+	//Two rounds of LimitOutgoingConnections share the second
+	budget := newTimeBudget(1, 2*LimitOutgoingConnections, MinTimeout)
+	share, clamped := budget.timeout(time.Minute)
+	if clamped || share < 400*time.Millisecond || share > 500*time.Millisecond {
+		t.Fatal(share, clamped)
+	}
+	if share, _ := newTimeBudget(10, 3, MinTimeout).timeout(time.Second); share != 0 {
+		t.Fatal("full timeout fits", share)
+	}
+	if share, clamped := newTimeBudget(0.05, 3, MinTimeout).timeout(time.Second); !clamped || share != MinTimeout {
+		t.Fatal(share, clamped)
+	}
+}
+
+func TestStreamArray(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	rec := postCheck(batch(`"Stream":true`, srv.URL, down))
+	var results []UrlCheckResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || rec.Code != 200 || len(results) != 2 {
+		t.Fatal(rec.Code, rec.Body.String(), err)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatal(rec.Header())
+	}
+
+	//No fail-fast: the slow url is still checked after the closed one failed
+	slow := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	rec = postCheck(batch(`"Stream":true`, slow.URL, down))
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatal(rec.Body.String(), err)
+	}
+	if results[1].Index != 0 || !results[1].Healthy || results[0].Healthy {
+		t.Fatal(rec.Body.String())
+	}
+}
+
+func TestCollapse(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	response := decodeResponse(t, postCheck(batch(`"Collapse":true,"ErrorBudget":1`, srv.URL+"/0", srv.URL+"/1", down, srv.URL+"/3")))
+	if response.Urls != nil || len(response.Groups) != 2 {
+		t.Fatal(response)
+	}
+	if group := response.Groups[0]; group.Code != 200 || !group.Healthy || group.Count != 3 || group.Sample.Index != 0 {
+		t.Fatal(group)
+	}
+	if group := response.Groups[1]; group.Code != 10 || group.Healthy || group.Count != 1 {
+		t.Fatal(group)
+	}
+
+	if rec := postCheck(batch(`"Collapse":true,"MapByUrl":true`, srv.URL)); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestDeepHealth(t *testing.T) {
+	saved := outbound
+	outbound = &successWindow{}
+	defer func() { outbound = saved }()
+
+	deep := func() (int, HealthResponse) {
+		rec := httptest.NewRecorder()
+		healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz?deep=true", nil))
+		var health HealthResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &health)
+		return rec.Code, health
+	}
+
+	if code, health := deep(); code != 200 || health.Status != "ok" || health.Checks != 0 {
+		t.Fatal(code, health)
+	}
+	for i := 0; i < HealthMinChecks; i++ {
+		outbound.record(UrlCheckResult{Healthy: i < 2})
+	}
+	//Urls cut by the batch don't count
+	outbound.record(UrlCheckResult{ErrorKind: ErrorKindBatchTimeout})
+	if code, health := deep(); code != 503 || health.Status != "degraded" || health.Checks != HealthMinChecks || health.SuccessRate != 0.2 {
+		t.Fatal(code, health)
+	}
+
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	var accept, language string
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		accept, language = r.Header.Get("Accept"), r.Header.Get("Accept-Language")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Language", "de")
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{Accept: "application/json", AcceptLanguage: "de-DE"})
+	if err != nil || accept != "application/json" || language != "de-DE" || result.ContentType != "application/json" || result.ContentLanguage != "de" {
+		t.Fatal(result, accept, language, err)
+	}
+	if result, _ = checkOne(srv.URL, CheckOptions{}); result.ContentType != "" {
+		t.Fatal(result.ContentType)
+	}
+}
+
+func TestBusyGives503(t *testing.T) {
+	setConfig(t, func(config *Config) { config.QueueTimeout = 50 * time.Millisecond })
+	saved := checkSlots
+	checkSlots = newSlots(1)
+	defer func() { checkSlots = saved }()
+	checkSlots <- struct{}{}
+
+	rec := postCheck(batch("", "http://a.test"))
+	if rec.Code != 503 || !strings.Contains(rec.Body.String(), errBusy.Error()) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	//Chains and the benchmark wait for the same slots
+	rec = postCheck(batch(`"Chain":true`, "http://a.test"))
+	if rec.Code != 503 || !strings.Contains(rec.Body.String(), errBusy.Error()) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	benchmarkHandler(rec, httptest.NewRequest(http.MethodGet, "/benchmark?n=1", nil))
+	if !strings.Contains(rec.Body.String(), `"errors":1`) {
+		t.Fatal(rec.Body.String())
+	}
+}
+
+func TestUploadedUrls(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, _ := form.CreateFormFile("file", "urls.txt")
+	_, _ = fmt.Fprintf(file, "# monitored\n%s/a\n\n  %s/b  \r\n", srv.URL, srv.URL)
+	_ = form.Close()
+
+	rec := postCheck(body.String(), "Content-Type", form.FormDataContentType())
+	response := decodeResponse(t, rec)
+	if len(response.Urls) != 2 || !response.Urls[1].Healthy || !strings.Contains(response.Urls[1].Message, "/b code") {
+		t.Fatal(rec.Body.String())
+	}
+
+	if rec := postCheck("--x--", "Content-Type", "multipart/form-data; boundary=x"); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestStreamSummary(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	rec := postCheck(batch(`"Stream":true,"StreamSummary":true,"SortBy":"status"`, paths(srv.URL, 2)...))
+	var items []json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil || len(items) != 3 {
+		t.Fatal(rec.Body.String(), err)
+	}
+	var summary StreamDone
+	if err := json.Unmarshal(items[2], &summary); err != nil || !summary.Done || len(summary.Urls) != 2 || summary.Urls[0].Code != 404 {
+		t.Fatal(string(items[2]), err)
+	}
+}
+
+type countingResolver struct {
+	lookups int32
+}
+
+func (r *countingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	atomic.AddInt32(&r.lookups, 1)
+	return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+}
+
+func TestDNSCache(t *testing.T) {
+	counting := &countingResolver{}
+	cache := newCachingResolver(counting, 50*time.Millisecond)
+
+	var hit atomic.Bool
+	ctx := context.WithValue(context.Background(), dnsCacheHitKey{}, &hit)
+	_, _ = cache.LookupIPAddr(ctx, "a.test")
+	if hit.Load() {
+		t.Fatal("first lookup cached")
+	}
+	_, _ = cache.LookupIPAddr(ctx, "a.test")
+	if !hit.Load() || counting.lookups != 1 {
+		t.Fatal(counting.lookups)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	_, _ = cache.LookupIPAddr(ctx, "a.test")
+	if counting.lookups != 2 {
+		t.Fatal("expired entry reused")
+	}
+}
+
+func TestConnReused(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	first, _ := checkOne(srv.URL, CheckOptions{})
+	second, err := checkOne(srv.URL, CheckOptions{})
+	if first.ConnReused || !second.ConnReused || err != nil {
+		t.Fatal(first.ConnReused, second.ConnReused, err)
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	cases := []struct {
+		options string
+		code    int
+	}{
+		{`"ErrorBudget":0`, 424},
+		{`"ErrorBudget":1`, 200},
+		{`"ErrorBudgetPercent":50`, 200},
+		{`"ErrorBudgetPercent":40`, 424},
+	}
+	for _, c := range cases {
+		rec := postCheck(batch(c.options, srv.URL, down))
+		response := decodeResponse(t, rec)
+		if rec.Code != c.code || response.OverBudget != (c.code == 424) || len(response.Urls) != 2 {
+			t.Error(c.options, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestMethodsWithBodies(t *testing.T) {
+	var method, body, contentType string
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		method, body, contentType = r.Method, string(data), r.Header.Get("Content-Type")
+	})
+
+	response := decodeResponse(t, postCheck(batch(`"Method":"PATCH","Body":"{\"a\":1}"`, srv.URL)))
+	if !response.Urls[0].Healthy || method != "PATCH" || body != `{"a":1}` || contentType != "application/json" {
+		t.Fatal(method, body, contentType)
+	}
+
+	for _, options := range []string{`"Method":"TRACE"`, `"Method":"GET","Body":"x"`, `"Method":"POST","ExpectContinue":true`} {
+		if rec := postCheck(batch(options, srv.URL)); rec.Code != 400 {
+			t.Error(options, rec.Code)
+		}
+	}
+}
+
+func TestBadGzip(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write([]byte("this is not gzip at all"))
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if err == nil || result.ErrorKind != ErrorKindBadEncoding || result.Code != 200 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestRedirectCount(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+			case "/a":
+				http.Redirect(w, r, "/b", http.StatusFound)
+			case "/b":
+				http.Redirect(w, r, "/c", http.StatusFound)
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/a", CheckOptions{})
+	if err != nil || result.RedirectCount != 2 || result.FinalUrl != srv.URL+"/c" {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/c", CheckOptions{}); result.RedirectCount != 0 || result.FinalUrl != "" {
+		t.Fatal(result)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	srv := serveTLS(t, func(w http.ResponseWriter, r *http.Request) {})
+	trustTestCert(t, srv)
+
+	//The test certificate is for example.com
+	result, err := checkOne(srv.URL, CheckOptions{ServerName: "example.com"})
+	if err != nil || result.SNI != "example.com" {
+		t.Fatal(result, err)
+	}
+	if result, err = checkOne(srv.URL, CheckOptions{ServerName: "other.test"}); err == nil {
+		t.Fatal(result)
+	}
+}
+
+func TestCompareProtocols(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 1 {
+			w.WriteHeader(http.StatusUpgradeRequired)
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	trustTestCert(t, srv)
+
+	result, err := checkOne(srv.URL, CheckOptions{CompareProtocols: true})
+	if err != nil || result.Proto != "HTTP/2.0" || result.HTTP1 == nil || result.HTTP1.Proto != "HTTP/1.1" || result.HTTP1.Code != 426 || !result.ProtoMismatch {
+		t.Fatal(result, err)
+	}
+}
+
+func TestReturnBodyLines(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/binary" {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		_, _ = w.Write([]byte("v1.2.3\r\nbuilt today\nthird\n"))
+	})
+
+	result, err := checkOne(srv.URL+"/text", CheckOptions{ReturnBodyLines: 2})
+	if err != nil || fmt.Sprint(result.BodyLines) != "[v1.2.3 built today]" || result.LineCount != 3 {
+		t.Fatal(result.BodyLines, result.LineCount, err)
+	}
+	if result, _ = checkOne(srv.URL+"/binary", CheckOptions{ReturnBodyLines: 2}); result.BodyLines != nil {
+		t.Fatal(result.BodyLines)
+	}
+}
+
+func TestCollectorPanicFailsBatch(t *testing.T) {
+	useHooks(t, func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+		result.Url = nil
+		return result, err
+	})
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postCheck(batch("", paths(srv.URL, 5)...)) }()
+	select {
+		case rec := <-done:
+			if rec.Code != 500 {
+				t.Fatal(rec.Code, rec.Body.String())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("workers blocked on the collector")
+	}
+
+	//A stream has its status sent already, it ends with an error element
+	rec := postCheck(batch(`"Stream":true`, paths(srv.URL, 2)...))
+	var items []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil || len(items) == 0 || items[len(items)-1]["error"] != "internal error" {
+		t.Fatal(rec.Body.String(), err)
+	}
+}
+
+//Client gone after the first n writes
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *brokenWriter) Write(b []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errors.New("broken pipe")
+	}
+	w.n--
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStreamWriteErrorCancels(t *testing.T) {
+	var canceled int32
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+				case <-time.After(2 * time.Second):
+				case <-r.Context().Done():
+					atomic.AddInt32(&canceled, 1)
+			}
+		}
+	})
+
+	start := time.Now()
+	w := &brokenWriter{ResponseRecorder: httptest.NewRecorder(), n: 1}
+	checkHandler(w, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(batch(`"Stream":true`, srv.URL+"/fast", otherHost(srv)+"/slow"))))
+	if elapsed := time.Since(start); elapsed > time.Second || w.Body.String() != "[" {
+		t.Fatal(elapsed, w.Body.String())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&canceled) != 1 {
+		t.Fatal("slow check not canceled")
+	}
+}
+
+func TestTrustedKeySkipsRateLimit(t *testing.T) {
+	setConfig(t, func(config *Config) { config.TrustedKeys = []string{"internal"} })
+	saved := limiter
+	limiter = rate.NewLimiter(0, 0)
+	defer func() { limiter = saved }()
+
+	h := limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for key, code := range map[string]int{"": 429, "wrong": 429, "internal": 200} {
+		req := httptest.NewRequest(http.MethodPost, "/check", nil)
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Error(key, rec.Code)
+		}
+	}
+}
+
+func TestApiKeys(t *testing.T) {
+	setConfig(t, func(config *Config) {
+		config.ApiKeys = []string{"k1", "k2"}
+		config.TrustedKeys = []string{"internal"}
+	})
+
+	h := auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for key, code := range map[string]int{"": 401, "k3": 401, "k2": 200, "internal": 200} {
+		req := httptest.NewRequest(http.MethodPost, "/check", nil)
+		req.Header.Set("X-Api-Key", key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Error(key, rec.Code)
+		}
+	}
+}
+
+func TestHashBodyDuplicates(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/2" {
+			_, _ = w.Write([]byte("other"))
+			return
+		}
+		_, _ = w.Write([]byte("same"))
+	})
+
+	response := decodeResponse(t, postCheck(batch(`"HashBody":true`, paths(srv.URL, 3)...)))
+	if len(response.Duplicates) != 1 || response.Urls[0].BodyHash != response.Urls[1].BodyHash || response.Urls[2].BodyHash == response.Urls[0].BodyHash {
+		t.Fatal(response.Duplicates, response.Urls)
+	}
+	if paths := response.Duplicates[response.Urls[0].BodyHash]; len(paths) != 2 {
+		t.Fatal(paths)
+	}
+}
+
+func TestPhasesOfFailedCheck(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+		}
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{TimeoutMs: 100})
+	if err == nil || result.ConnectTime <= 0 || result.RemoteIP != "127.0.0.1" {
+		t.Fatal(result, err)
+	}
+}
+
+func TestStaleOCSP(t *testing.T) {
+	srv := serveTLS(t, func(w http.ResponseWriter, r *http.Request) {})
+	trustTestCert(t, srv)
+	stapleOCSP(t, srv, time.Now().Add(-time.Hour))
+
+	result, err := checkOne(srv.URL, CheckOptions{ReportOCSP: true, OCSPMaxAge: 60})
+	if err != nil || !result.Healthy || result.OCSPStatus != "stale" || len(result.Warnings) != 1 || !result.Degraded {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL, CheckOptions{ReportOCSP: true, OCSPMaxAge: 7200}); result.OCSPStatus != "good" || result.Degraded {
+		t.Fatal(result)
+	}
+}
+
+func TestUrlsInQuery(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest(http.MethodGet, "/check?urls="+url.QueryEscape(srv.URL+"/a, "+srv.URL+"/b,"), nil)
+	rec := httptest.NewRecorder()
+	checkHandler(rec, req)
+	response := decodeResponse(t, rec)
+	if rec.Code != 200 || len(response.Urls) != 2 || !response.Urls[1].Healthy {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hints" {
+			w.Header().Set("Link", "</app.css>; rel=preload")
+			w.WriteHeader(http.StatusEarlyHints)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	result, err := checkOne(srv.URL+"/hints", CheckOptions{})
+	if err != nil || !result.EarlyHints || result.Code != 200 {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/plain", CheckOptions{}); result.EarlyHints {
+		t.Fatal(result)
+	}
+}
+
+func TestHealthyKinds(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+		}
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{TimeoutMs: 100, HealthyKinds: []string{ErrorKindUrlTimeout}})
+	if err != nil || !result.Healthy || result.ErrorKind != ErrorKindUrlTimeout || !strings.Contains(result.Message, "Expected url_timeout") {
+		t.Fatal(result, err)
+	}
+	if _, err := checkOne(srv.URL, CheckOptions{TimeoutMs: 100, HealthyKinds: []string{ErrorKindDNSNotFound}}); err == nil {
+		t.Fatal("other kind healthy")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	type upload struct {
+		path, auth string
+		body       []byte
+	}
+	uploads := make(chan upload, 1)
+	bucket := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploads <- upload{path: r.URL.Path, auth: r.Header.Get("Authorization"), body: body}
+	})
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	if rec := postCheck(batch(`"Archive":true`, srv.URL)); rec.Code != 400 || !strings.Contains(rec.Body.String(), "archive not configured") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	setConfig(t, func(config *Config) {
+		config.S3Endpoint = bucket.URL + "/"
+		config.S3Bucket = "checks"
+		config.S3AccessKey = "AKID"
+		config.S3SecretKey = "secret"
+	})
+	for _, other := range []*httptest.ResponseRecorder{
+		postCheck(batch(`"Archive":true,"Stream":true`, srv.URL)),
+		postCheck(batch(`"Archive":true`, srv.URL), "Accept", "text/plain; version=0.0.4"),
+		postCheck(batch(`"Archive":true`, srv.URL), "Accept", "application/vnd.junit+xml"),
+	} {
+		if other.Code != 400 || !strings.Contains(other.Body.String(), "Archive needs the JSON response") {
+			t.Fatal(other.Code, other.Body.String())
+		}
+	}
+
+	rec := postCheck(batch(`"Archive":true`, srv.URL))
+	response := decodeResponse(t, rec)
+	if !regexp.MustCompile(`^checks/\d{4}/\d{2}/\d{2}/\d+-\d{6}\.json$`).MatchString(response.ArchiveKey) {
+		t.Fatal(response.ArchiveKey)
+	}
+
+	select {
+		case got := <-uploads:
+			if got.path != "/checks/"+response.ArchiveKey || !bytes.Equal(got.body, rec.Body.Bytes()) {
+				t.Fatal(got.path, string(got.body))
+			}
+			if !strings.HasPrefix(got.auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(got.auth, "/us-east-1/s3/aws4_request") {
+				t.Fatal(got.auth)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("not archived")
+	}
+}
+
+func TestArchiveSignsWithBatchConfig(t *testing.T) {
+	setConfig(t, func(config *Config) { config.S3AccessKey = "LIVE" })
+	batchConfig := &Config{S3AccessKey: "BATCH", S3Region: "eu-west-1"}
+
+	//A reload during the batch doesn't change what it started with
+	req := httptest.NewRequest(http.MethodPut, "http://s3.test/bucket/key", nil)
+	signV4(batchConfig, req, nil, time.Now().UTC())
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "Credential=BATCH/") || !strings.Contains(auth, "/eu-west-1/s3/") {
+		t.Fatal(auth)
+	}
+}
+
+func TestNotCheckedKinds(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	canceled, cancelIt := context.WithCancel(context.Background())
+	cancelIt()
+	failed, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(errors.New("url failed"))
+
+	cases := []struct {
+		ctx  context.Context
+		err  error
+		kind string
+	}{
+		{context.Background(), errBusy, ErrorKindQueueTimeout},
+		{expired, nil, ErrorKindBatchTimeout},
+		{canceled, nil, ErrorKindClientCanceled},
+		{failed, nil, ErrorKindNotAttempted},
+	}
+	for _, c := range cases {
+		result := notChecked(Url{path: "http://a.test", index: 3}, c.ctx, c.err)
+		if result.ErrorKind != c.kind || result.Code != 0 || result.Index != 3 || !strings.HasPrefix(result.Message, "0.00 Not attempted") {
+			t.Error(c.kind, result)
+		}
+	}
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	var mu sync.Mutex
+	var starts []time.Time
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+	})
+
+	rec := postCheck(batch(`"RequestsPerSecond":10,"HostConcurrency":3`, paths(srv.URL, 3)...))
+	if rec.Code != 200 || len(starts) != 3 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	for i := 1; i < len(starts); i++ {
+		if gap := starts[i].Sub(starts[i-1]); gap < 80*time.Millisecond {
+			t.Fatal(i, gap)
+		}
+	}
+	if rec := postCheck(batch(`"RequestsPerSecond":-1`, srv.URL)); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestSNIRequired(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	cert := srv.TLS.Certificates[0]
+	srv.TLS.Certificates = nil
+	srv.TLS.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName == "" {
+			return nil, errors.New("no sni")
+		}
+		return &cert, nil
+	}
+	trustTestCert(t, srv)
+
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if err == nil || result.ErrorKind != ErrorKindSNIRequired || !strings.Contains(result.Message, "ServerName") {
+		t.Fatal(result, err)
+	}
+	if _, err := checkOne(srv.URL, CheckOptions{ServerName: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupByHost(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	response := decodeResponse(t, postCheck(batch(`"GroupByHost":true,"ErrorBudget":1`, srv.URL+"/a", otherHost(srv)+"/b", srv.URL+"/c", strings.Replace(down, "127.0.0.1", "localhost", 1))))
+	if response.Urls != nil || len(response.Hosts) != 2 {
+		t.Fatal(response)
+	}
+	local, other := response.Hosts["127.0.0.1"], response.Hosts["localhost"]
+	if local == nil || other == nil || local.Healthy != 2 || len(local.Urls) != 2 || other.Healthy != 1 || other.Unhealthy != 1 || local.Latency == nil {
+		t.Fatal(response.Hosts)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/read" {
+			_, _ = io.ReadAll(r.Body)
+			return
+		}
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	})
+	opts := CheckOptions{Method: http.MethodPost, Body: "payload", BodyType: "text/plain", ExpectContinue: true}
+
+	result, err := checkOne(srv.URL+"/read", opts)
+	if err != nil || result.GotContinue == nil || !*result.GotContinue {
+		t.Fatal(result, err)
+	}
+	result, err = checkOne(srv.URL+"/refuse", opts)
+	if err != nil || result.GotContinue == nil || *result.GotContinue || result.Code != 413 {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/read", CheckOptions{}); result.GotContinue != nil {
+		t.Fatal(result)
+	}
+}
+
+func TestResponseAge(t *testing.T) {
+	now := time.Now()
+	header := func(date time.Time, age string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+		if age != "" {
+			resp.Header.Set("Age", age)
+		}
+		return resp
+	}
+
+	if age := responseAge(header(now.Add(-10*time.Second), ""), now, now); age < 9 || age > 11 {
+		t.Fatal(age)
+	}
+	if age := responseAge(header(now, "30"), now.Add(-2*time.Second), now); age != 32 {
+		t.Fatal(age)
+	}
+	if age := responseAge(header(now.Add(time.Hour), ""), now, now); age != 0 {
+		t.Fatal("skewed clock", age)
+	}
+}
+
+func TestWriteTimeoutEndsBatch(t *testing.T) {
+	setConfig(t, func(config *Config) { config.WriteTimeout = 300 * time.Millisecond })
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+		}
+	})
+
+	start := time.Now()
+	rec := postCheck(batch(`"TimeoutMs":2000`, srv.URL))
+	response := decodeResponse(t, rec)
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond || !response.Partial || response.Cause != CauseBatchTimeout {
+		t.Fatal(elapsed, rec.Body.String())
+	}
+
+	//A slowly sent request body uses up the batch time too
+	start = time.Now()
+	body := io.MultiReader(strings.NewReader(`{"urls":["`+srv.URL+`"],`), slowReader{delay: 150 * time.Millisecond}, strings.NewReader(`"TimeoutMs":2000}`))
+	rec = httptest.NewRecorder()
+	checkHandler(rec, httptest.NewRequest(http.MethodPost, "/check", body))
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond || !decodeResponse(t, rec).Partial {
+		t.Fatal(elapsed, rec.Body.String())
+	}
+}
+
+//Waits before its EOF
+type slowReader struct {
+	delay time.Duration
+}
+
+func (r slowReader) Read([]byte) (int, error) {
+	time.Sleep(r.delay)
+	return 0, io.EOF
+}
+
+func TestVerdict(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	down := closedUrl(t)
+
+	cases := []struct {
+		options, verdict string
+	}{
+		{`"Verdict":"all_healthy"`, "pass"},
+		{`"Verdict":"all_healthy","ErrorBudget":1,"fail":1`, "fail"},
+		{`"Verdict":"error_budget","ErrorBudget":1,"fail":1`, "pass"},
+		{`"Verdict":"error_budget","ErrorBudgetPercent":10,"fail":1`, "fail"},
+	}
+	for _, c := range cases {
+		urls := []string{srv.URL}
+		options := c.options
+		if strings.HasSuffix(options, `,"fail":1`) {
+			urls = append(urls, down)
+			options = strings.TrimSuffix(options, `,"fail":1`)
+		}
+		if response := decodeResponse(t, postCheck(batch(options, urls...))); response.Verdict != c.verdict {
+			t.Error(c.options, response.Verdict)
+		}
+	}
+
+	for _, options := range []string{`"Verdict":"vibes"`, `"Verdict":"error_budget"`} {
+		if rec := postCheck(batch(options, srv.URL)); rec.Code != 400 {
+			t.Error(options, rec.Code)
+		}
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	var head int32
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&head, 1)
+		}
+	})
+
+	warmUp(context.Background(), []string{srv.URL, "://bad"})
+	result, err := checkOne(srv.URL, CheckOptions{})
+	if head != 1 || err != nil || !result.ConnReused {
+		t.Fatal(head, result, err)
+	}
+}
+
+func TestMetaRefresh(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+			case "/moved":
+				_, _ = fmt.Fprint(w, `<html><head><META HTTP-EQUIV="Refresh" CONTENT="0; URL='/next'"></head></html>`)
+			case "/reload":
+				_, _ = fmt.Fprint(w, `<meta http-equiv="refresh" content="30">`)
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/moved", CheckOptions{CheckMetaRefresh: true})
+	if err != nil || result.MetaRefresh != srv.URL+"/next" {
+		t.Fatal(result, err)
+	}
+	result, err = checkOne(srv.URL+"/reload", CheckOptions{CheckMetaRefresh: true})
+	if err == nil || result.ErrorKind != ErrorKindMetaRefreshLoop {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/moved", CheckOptions{}); result.MetaRefresh != "" {
+		t.Fatal(result.MetaRefresh)
+	}
+}
+
+func TestMapByUrl(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	response := decodeResponse(t, postCheck(batch(`"MapByUrl":true`, srv.URL+"/a", srv.URL+"/b")))
+	if response.Urls != nil || len(response.ByUrl) != 2 || response.ByUrl[srv.URL+"/b"].Index != 1 {
+		t.Fatal(response)
+	}
+
+	rec := postCheck(batch(`"MapByUrl":true`, srv.URL+"/a", srv.URL+"/a"))
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "duplicate url") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestCompareSlashes(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/docs/" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	result, err := checkOne(srv.URL+"/docs", CheckOptions{CompareSlashes: true})
+	if err != nil || result.Slash == nil || result.Slash.Code != 404 || !result.SlashMismatch {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL+"/", CheckOptions{CompareSlashes: true}); result.Slash != nil {
+		t.Fatal("root has no slash variant")
+	}
+
+	cases := map[string]string{
+		"http://a.test/x": "http://a.test/x/",
+		"http://a.test/x/?q=1": "http://a.test/x?q=1",
+		"http://a.test": "",
+		"http://a.test/": "",
+	}
+	for path, variant := range cases {
+		if got := toggleSlash(path); got != variant {
+			t.Error(path, got)
+		}
+	}
+}
+
+func TestPreviewRequests(t *testing.T) {
+	var hits int32
+	srv := serveCounter(t, &hits)
+	u, _ := url.Parse(srv.URL)
+
+	rec := postCheck(batch(`"PreviewRequests":true,"Method":"POST","Body":"{}","UserAgents":["probe"],"QueryParams":{"token":"t1"}`, "http://user:pw@"+u.Host+"/p"))
+	var preview PreviewResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil || len(preview.Requests) != 1 || hits != 0 {
+		t.Fatal(rec.Body.String(), err, hits)
+	}
+	request := preview.Requests[0]
+	if request.Method != "POST" || !strings.HasPrefix(request.Request, "POST /p?token=REDACTED HTTP/1.1\r\n") {
+		t.Fatal(request)
+	}
+	for _, line := range []string{"User-Agent: probe", "Content-Type: application/json", "Authorization: Basic "} {
+		if !strings.Contains(request.Request, line) {
+			t.Fatal(line, request.Request)
+		}
+	}
+	if strings.Contains(request.Request, "pw") || strings.Contains(request.Request, "t1") {
+		t.Fatal(request.Request)
+	}
+}
+
+func TestMaxHeaders(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+	})
+
+	//Set-Cookie twice, Content-Length and Date
+	result, err := checkOne(srv.URL, CheckOptions{MaxHeaders: 3})
+	if err == nil || result.ErrorKind != ErrorKindTooManyHeaders || result.HeaderCount != 4 {
+		t.Fatal(result, err)
+	}
+	if result, err = checkOne(srv.URL, CheckOptions{MaxHeaders: 4}); err != nil || result.HeaderCount != 4 {
+		t.Fatal(result, err)
+	}
+}
+
+type nilBodyTransport struct{}
+
+func (nilBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: 200, Status: "200 OK", Header: http.Header{}, Request: req}, nil
+}
+
+func TestNilResponseBody(t *testing.T) {
+	nilBody := newTransport()
+	nilBody.RegisterProtocol("nilbody", nilBodyTransport{})
+	t.Cleanup(nilBody.CloseIdleConnections)
+
+	result, err := checkOne("nilbody://a.test/", CheckOptions{transport: nilBody, HashBody: true})
+	if err != nil || result.Code != 200 || result.BodyHash == "" {
+		t.Fatal(result, err)
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	response := decodeResponse(t, postCheck(batch(`"HostConcurrency":1`, paths(srv.URL, 2)...)))
+	first, second := response.Urls[0], response.Urls[1]
+	if first.QueueWait > second.QueueWait {
+		first, second = second, first
+	}
+	if first.QueueWait > 0.05 || second.QueueWait < 0.09 || second.Time > 0.19 {
+		t.Fatal(first.QueueWait, second.QueueWait, second.Time)
+	}
+}
+
+func TestETag(t *testing.T) {
+	setConfig(t, func(config *Config) { config.ETagTTL = time.Minute })
+	saved := etags
+	etags = &etagCache{entries: map[string]etagEntry{}}
+	defer func() { etags = saved }()
+	var hits int32
+	srv := serveCounter(t, &hits)
+	body := batch("", srv.URL)
+
+	first := postCheck(body)
+	etag := first.Header().Get("ETag")
+	if first.Code != 200 || !regexp.MustCompile(`^"[0-9a-f]{32}"$`).MatchString(etag) {
+		t.Fatal(first.Code, etag)
+	}
+
+	if rec := postCheck(body, "If-None-Match", etag); rec.Code != 304 || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag || hits != 1 {
+		t.Fatal(rec.Code, hits)
+	}
+	if rec := postCheck(body, "If-None-Match", `"other"`); rec.Code != 200 || rec.Header().Get("ETag") != etag || hits != 2 {
+		t.Fatal(rec.Code, hits)
+	}
+	if rec := postCheck(batch(`"HashBody":true`, srv.URL)); rec.Header().Get("ETag") == etag {
+		t.Fatal("other request, same ETag")
+	}
+}
+
+func TestUserAgentPool(t *testing.T) {
+	saved := userAgentRand
+	userAgentRand = newLockedRand(1)
+	defer func() { userAgentRand = saved }()
+	var sent string
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) { sent = r.UserAgent() })
+
+	pool := []string{"agent-a", "agent-b", "agent-c"}
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		result, err := checkOne(srv.URL, CheckOptions{UserAgents: pool})
+		if err != nil || result.UserAgent != sent {
+			t.Fatal(result.UserAgent, sent, err)
+		}
+		seen[sent] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal(seen)
+	}
+}
+
+func TestTinyTimeoutClamped(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) { time.Sleep(20 * time.Millisecond) })
+
+	response := decodeResponse(t, postCheck(batch(`"TimeoutMs":1`, srv.URL)))
+	if result := response.Urls[0]; !result.Healthy || !result.TimeoutClamped {
+		t.Fatal(result)
+	}
+	if opts := (CheckOptions{TimeoutMs: 1}).normalized(); opts.urlTimeout() != MinTimeout {
+		t.Fatal(opts.urlTimeout())
+	}
+}
+
+func TestReportOptions(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	response := decodeResponse(t, postCheck(batch(`"ReportOptions":true,"TimeoutMs":50,"Retries":7,"MaxBytes":99`, srv.URL)))
+	options := response.EffectiveOptions
+	if options == nil || options.Timeout != MinTimeout.Seconds() || !options.TimeoutClamped || options.Retries != RetryLimit ||
+		options.RetryJitter != "full" || !options.FollowRedirects || options.Samples != 1 || options.MaxBytes != 99 || options.HostConcurrency != 1 {
+		t.Fatal(options)
+	}
+}
+
+func TestUrlsSource(t *testing.T) {
+	setConfig(t, func(config *Config) { config.SourcePrivate = true })
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	var source *httptest.Server
+	source = serve(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+			case "/list":
+				_, _ = fmt.Fprintf(w, `{"urls":["%s/1","%s/2"],"next":"/more"}`, srv.URL, srv.URL)
+			case "/more":
+				_, _ = fmt.Fprintf(w, `["%s/3"]`, srv.URL)
+			case "/loop":
+				_, _ = fmt.Fprintf(w, `{"urls":["%s/1"],"next":"/loop"}`, srv.URL)
+			case "/slow":
+				select {
+					case <-time.After(2 * time.Second):
+					case <-r.Context().Done():
+				}
+			default:
+				w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	response := decodeResponse(t, postCheck(`{"urls":["`+srv.URL+`/0"],"UrlsSource":"`+source.URL+`/list"}`))
+	if len(response.Urls) != 4 || !strings.Contains(response.Urls[3].Message, "/3 code") {
+		t.Fatal(response.Urls)
+	}
+
+	for path, problem := range map[string]string{"/missing": "code 404", "/loop": "more than 10 pages"} {
+		rec := postCheck(`{"UrlsSource":"` + source.URL + path + `"}`)
+		if rec.Code != 400 || !strings.Contains(rec.Body.String(), problem) {
+			t.Error(path, rec.Code, rec.Body.String())
+		}
+	}
+
+	//The batch deadline covers fetching the list
+	start := time.Now()
+	rec := postCheck(`{"UrlsSource":"`+source.URL+`/slow"}`, "X-Deadline", "0.2")
+	if elapsed := time.Since(start); rec.Code != 400 || elapsed > time.Second {
+		t.Fatal(rec.Code, elapsed)
+	}
+
+	setConfig(t, func(config *Config) { config.SourcePrivate = false })
+	sourceClient.CloseIdleConnections()
+	rec = postCheck(`{"UrlsSource":"` + source.URL + `/list"}`)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), "not allowed") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestSourceDialsWithBatchConfig(t *testing.T) {
+	setConfig(t, func(config *Config) { config.SourcePrivate = false })
+	batchConfig := &Config{SourcePrivate: true}
+
+	//A reload during the batch doesn't change what it started with
+	if err := publicOnly(withConfig(context.Background(), batchConfig), "tcp4", "127.0.0.1:80", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := publicOnly(context.Background(), "tcp4", "127.0.0.1:80", nil); err == nil {
+		t.Fatal("loopback allowed by the live config")
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	var sent []string
+	var mu sync.Mutex
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent = append(sent, r.Header.Get("Traceparent"))
+		mu.Unlock()
+	})
+
+	incoming := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	response := decodeResponse(t, postCheck(batch(`"TraceParent":true`, srv.URL+"/a", srv.URL+"/b"), "Traceparent", incoming))
+	pattern := regexp.MustCompile(`^00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01$`)
+	if len(sent) != 2 || !pattern.MatchString(sent[0]) || sent[0] == sent[1] || response.Urls[0].TraceParent == "" {
+		t.Fatal(sent, response.Urls)
+	}
+
+	if trace := batchTrace(httptest.NewRequest(http.MethodPost, "/check", nil)); !regexp.MustCompile(`^[0-9a-f]{32}-01$`).MatchString(trace) {
+		t.Fatal(trace)
+	}
+}
+
+func TestAttemptStatuses(t *testing.T) {
+	var hits int32
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{Retries: 2, RetryStatuses: []int{503}, RetryJitter: "none"})
+	if err != nil || result.Code != 200 || result.Attempts != 2 || fmt.Sprint(result.AttemptStatuses) != "[503 200]" {
+		t.Fatal(result, err)
+	}
+	if result, _ = checkOne(srv.URL, CheckOptions{}); result.Attempts != 0 || result.AttemptStatuses != nil {
+		t.Fatal(result)
+	}
+}
+
+//TLS server with a handshake of at least delay
+func serveSlowTLS(t *testing.T, delay time.Duration) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	cert := srv.TLS.Certificates[0]
+	srv.TLS.Certificates = nil
+	srv.TLS.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		time.Sleep(delay)
+		return &cert, nil
+	}
+	trustTestCert(t, srv)
+	return srv
+}
+
+func TestSlowTLSWarning(t *testing.T) {
+	srv := serveSlowTLS(t, 50*time.Millisecond)
+
+	result, err := checkOne(srv.URL, CheckOptions{WarnOn: []string{"slow_tls"}, SlowTLSMs: 10})
+	if err != nil || !result.Healthy || !result.Degraded || len(result.Warnings) != 1 || !strings.HasPrefix(result.Warnings[0], "slow TLS handshake") {
+		t.Fatal(result, err)
+	}
+	transport.CloseIdleConnections()
+	if result, _ = checkOne(srv.URL, CheckOptions{WarnOn: []string{"slow_tls"}}); result.Warnings != nil || result.Degraded {
+		t.Fatal(result.Warnings)
+	}
+
+	//The threshold applies without WarnOn too
+	transport.CloseIdleConnections()
+	result, err = checkOne(srv.URL, CheckOptions{SlowTLSMs: 10})
+	if err != nil || !result.Degraded || len(result.Warnings) != 1 {
+		t.Fatal(result, err)
+	}
+}
+
+func TestHostDelay(t *testing.T) {
+	var mu sync.Mutex
+	starts := map[string][]time.Time{}
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		starts[r.Host] = append(starts[r.Host], time.Now())
+		mu.Unlock()
+	})
+	local := strings.TrimPrefix(srv.URL, "http://")
+
+	rec := postCheck(batch(`"HostConcurrency":3,"HostDelayMs":100,"HostDelays":{"localhost":0}`, srv.URL+"/1", srv.URL+"/2", otherHost(srv)+"/3", otherHost(srv)+"/4"))
+	if rec.Code != 200 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	spaced := starts[local]
+	sort.Slice(spaced, func(i, j int) bool { return spaced[i].Before(spaced[j]) })
+	if len(spaced) != 2 || spaced[1].Sub(spaced[0]) < 90*time.Millisecond {
+		t.Fatal(spaced)
+	}
+	if rec := postCheck(batch(`"HostDelays":{"a.test":-1}`, "http://a.test")); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestRequestBytes(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	plain, err := checkOne(srv.URL, CheckOptions{ReportRequestBytes: true})
+	if err != nil || plain.RequestBytes == 0 {
+		t.Fatal(plain, err)
+	}
+	posted, _ := checkOne(srv.URL, CheckOptions{ReportRequestBytes: true, Method: http.MethodPost, Body: "hello", BodyType: "text/plain"})
+	//Body, Content-Length: 5 and Content-Type: text/plain lines on top of the plain GET
+	if grown := posted.RequestBytes - plain.RequestBytes; grown != len("hello")+len("Content-Length: 5\r\n")+len("Content-Type: text/plain\r\n")+1 {
+		t.Fatal(plain.RequestBytes, posted.RequestBytes)
+	}
+}
+
+func TestStopCause(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	canceled, cancelIt := context.WithCancel(context.Background())
+	cancelIt()
+	failed, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(errors.New("url failed"))
+
+	for ctx, cause := range map[context.Context]string{expired: CauseBatchTimeout, canceled: CauseClientDisconnect, failed: CauseFailFast, context.Background(): CauseFailFast} {
+		if got := stopCause(ctx); got != cause {
+			t.Error(cause, got)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+			case "/good":
+				_, _ = fmt.Fprint(w, `{"ok":true}`)
+			case "/bad":
+				_, _ = fmt.Fprint(w, `{"ok":"yes"}`)
+			default:
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprint(w, `<html>`)
+		}
+	})
+	schema := `"ExpectJSONSchema":{"type":"object","required":["ok"],"properties":{"ok":{"type":"boolean"}}},"ErrorBudget":3`
+
+	response := decodeResponse(t, postCheck(batch(schema, srv.URL+"/good", srv.URL+"/bad", srv.URL+"/html")))
+	good, bad, html := response.Urls[0], response.Urls[1], response.Urls[2]
+	if !good.Healthy || bad.ErrorKind != ErrorKindSchemaMismatch || len(bad.SchemaErrors) == 0 || !strings.HasPrefix(bad.SchemaErrors[0], "/ok") || html.ErrorKind != ErrorKindNotJSON {
+		t.Fatal(response.Urls)
+	}
+
+	if rec := postCheck(batch(`"ExpectJSONSchema":{"type":12}`, srv.URL)); rec.Code != 400 || !strings.Contains(rec.Body.String(), "bad json schema") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestPortConnLimit(t *testing.T) {
+	setConfig(t, func(config *Config) { config.PortConnLimit = 1 })
+	saved := transport
+	transport = newTransport()
+	t.Cleanup(func() {
+		transport.CloseIdleConnections()
+		transport = saved
+	})
+	var peak peakCounter
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peak.enter()
+		defer peak.leave()
+		time.Sleep(50 * time.Millisecond)
+	}))
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	if rec := postCheck(batch(`"HostConcurrency":3`, paths(srv.URL, 3)...)); rec.Code != 200 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if peak.peak != 1 || conns != 1 {
+		t.Fatal(peak.peak, conns)
+	}
+}
+
+func TestCheckHTTP3(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":443"; ma=60`)
+		if r.ProtoMajor == 3 {
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	udp, err := net.ListenPacket("udp", "127.0.0.1:"+port); if err != nil {
+		t.Skip(err)
+	}
+	h3srv := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(srv.TLS.Clone())}
+	go func() { _ = h3srv.Serve(udp) }()
+	trustTestCert(t, srv)
+	saved := h3Transport
+	h3Transport = newH3Transport(transport.TLSClientConfig)
+	defer func() {
+		_ = h3Transport.Close()
+		h3Transport = saved
+	}()
+
+	result, err := checkOne(srv.URL, CheckOptions{CheckHTTP3: true})
+	if err != nil || !result.H3Advertised || result.HTTP3 == nil || !result.HTTP3.Healthy || result.HTTP3.Code != 201 || result.HTTP3.Proto != "HTTP/3.0" || result.Code != 200 {
+		t.Fatal(result, err)
+	}
+
+	//No QUIC listener: h3 isn't reachable, the url stays healthy
+	_ = h3srv.Close()
+	_ = udp.Close()
+	result, err = checkOne(srv.URL, CheckOptions{CheckHTTP3: true, TimeoutMs: 300})
+	if err != nil || result.HTTP3 == nil || result.HTTP3.Healthy {
+		t.Fatal(result, err)
+	}
+}
+
+func TestReportAltSvc(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Alt-Svc", `h3=":443"; ma=86400, h3-29=":443"`)
+		w.Header().Add("Alt-Svc", `h2="alt.test:443"`)
+	})
+
+	result, err := checkOne(srv.URL, CheckOptions{ReportAltSvc: true})
+	if err != nil || result.AltSvc != `h3=":443"; ma=86400, h3-29=":443", h2="alt.test:443"` {
+		t.Fatal(result.AltSvc, err)
+	}
+	if result, _ = checkOne(srv.URL, CheckOptions{}); result.AltSvc != "" {
+		t.Fatal(result.AltSvc)
+	}
+}
+
+func TestSample(t *testing.T) {
+	saved := sampleRand
+	sampleRand = newLockedRand(3)
+	defer func() { sampleRand = saved }()
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	response := decodeResponse(t, postCheck(batch(`"Sample":2`, paths(srv.URL, UrlLimit+5)...)))
+	if len(response.Urls) != 2 || len(response.Sampled) != 2 || response.Sampled[0] >= response.Sampled[1] {
+		t.Fatal(response.Sampled, response.Urls)
+	}
+	for i, result := range response.Urls {
+		if !strings.Contains(result.Message, fmt.Sprintf("/%d code", response.Sampled[i])) {
+			t.Fatal(i, result)
+		}
+	}
+
+	if rec := postCheck(batch(`"Sample":-1`, srv.URL)); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+}
+
+func TestUnencodableResponse(t *testing.T) {
+	useHooks(t, func(url Url, result UrlCheckResult, err error) (UrlCheckResult, error) {
+		result.Annotations = map[string]interface{}{"score": math.Inf(1)}
+		return result, err
+	})
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	rec := postCheck(batch("", srv.URL))
+	if rec.Code != 500 || !strings.Contains(rec.Body.String(), "not encodable") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+}
+
+func TestReportTimestamps(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) { time.Sleep(20 * time.Millisecond) })
+
+	result, err := checkOne(srv.URL, CheckOptions{ReportTimestamps: true})
+	started, startErr := time.Parse(time.RFC3339Nano, result.StartedAt)
+	finished, finishErr := time.Parse(time.RFC3339Nano, result.FinishedAt)
+	if err != nil || startErr != nil || finishErr != nil || finished.Sub(started) < 20*time.Millisecond || started.Location() != time.UTC {
+		t.Fatal(result.StartedAt, result.FinishedAt, err)
+	}
+	if result, _ = checkOne(srv.URL, CheckOptions{}); result.StartedAt != "" {
+		t.Fatal(result.StartedAt)
+	}
+}
+
+func TestExpectBodyBytes(t *testing.T) {
+	srv := serve(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	five, four, zero := 5, 4, 0
+	for _, path := range []string{"/length", "/chunked"} {
+		if _, err := checkOne(srv.URL+path, CheckOptions{ExpectBodyBytes: &five}); err != nil {
+			t.Fatal(path, err)
+		}
+		result, err := checkOne(srv.URL+path, CheckOptions{ExpectBodyBytes: &four})
+		if err == nil || result.ErrorKind != ErrorKindBodySize || !strings.Contains(result.Message, "Body of 5 bytes, expected 4") {
+			t.Fatal(path, result, err)
+		}
+	}
+
+	//0 is an empty body, not "any size"
+	if result, err := checkOne(srv.URL, CheckOptions{ExpectBodyBytes: &zero}); err == nil || result.ErrorKind != ErrorKindBodySize {
+		t.Fatal(result, err)
+	}
+	empty := serve(t, func(w http.ResponseWriter, r *http.Request) {})
+	if response := decodeResponse(t, postCheck(batch(`"ExpectBodyBytes":0`, empty.URL))); !response.Urls[0].Healthy {
+		t.Fatal(response.Urls[0])
+	}
+
+	for _, options := range []string{`"ExpectBodyBytes":-1`, `"ExpectBodyBytes":10,"MaxBytes":5`} {
+		if rec := postCheck(batch(options, srv.URL)); rec.Code != 400 {
+			t.Error(options, rec.Code)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	saved := maintenance.Load()
+	defer maintenance.Store(saved)
+	setConfig(t, func(config *Config) { config.AdminKeys = []string{"admin"} })
+
+	toggle := func(on string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/maintenance?on="+on, nil)
+		req.Header.Set("X-Api-Key", "admin")
+		rec := httptest.NewRecorder()
+		admin(http.HandlerFunc(maintenanceHandler)).ServeHTTP(rec, req)
+		return rec
+	}
+	checks := underMaintenance(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	check := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		checks.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/check", nil))
+		return rec
+	}
+
+	if rec := toggle("true"); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"maintenance":true`) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if rec := check(); rec.Code != 503 || rec.Header().Get("Retry-After") != "300" {
+		t.Fatal(rec.Code, rec.Header())
+	}
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Body.String() != "maintenance" {
+		t.Fatal(rec.Body.String())
+	}
+
+	if rec := toggle("false"); rec.Code != 200 || check().Code != 200 {
+		t.Fatal(rec.Code)
+	}
+	if rec := toggle("maybe"); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/maintenance?on=true", nil)
+	rec = httptest.NewRecorder()
+	admin(http.HandlerFunc(maintenanceHandler)).ServeHTTP(rec, req)
+	if rec.Code != 401 || maintenance.Load() {
+		t.Fatal(rec.Code)
+	}
+}
+
+func reload(body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	reloadHandler(rec, httptest.NewRequest(http.MethodPost, "/admin/reload", strings.NewReader(body)))
+	return rec
+}
+
+func TestReloadConfig(t *testing.T) {
+	setConfig(t, func(config *Config) {})
+	savedOverrides := reloadOverrides
+	defer func() { reloadOverrides = savedOverrides }()
+	t.Setenv("HOST_LIMIT", "")
+	running := currentConfig()
+
+	rec := reload("# tuned\nHOST_LIMIT=3\nCHECK_LIMIT=7\n")
+	var response ReloadResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != 200 {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if config := currentConfig(); config == running || config.HostLimit != 3 || config.CheckLimit != running.CheckLimit {
+		t.Fatal(config.HostLimit, config.CheckLimit)
+	}
+	if fmt.Sprint(response.Restart) != "[CHECK_LIMIT]" {
+		t.Fatal(response.Restart)
+	}
+	if os.Getenv("HOST_LIMIT") != "" {
+		t.Fatal("process env changed")
+	}
+	//Overrides stay for later reloads
+	if reload(""); currentConfig().HostLimit != 3 {
+		t.Fatal(currentConfig().HostLimit)
+	}
+
+	before := currentConfig()
+	if rec := reload("BODY_LIMIT=lots"); rec.Code != 400 || !strings.Contains(rec.Body.String(), "BODY_LIMIT") || currentConfig() != before {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if rec := reload("no equals sign"); rec.Code != 400 {
+		t.Fatal(rec.Code)
+	}
+	if rec := reload("HOST_LIMTI=4\nPATH=/tmp"); rec.Code != 400 || !strings.Contains(rec.Body.String(), "unknown key") || currentConfig() != before {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+
+	//Maintenance and client rate limits apply without a restart
+	savedMaintenance, savedIps := maintenance.Load(), ipLimiters
+	ipLimiters = &ipLimiterStore{limiters: map[string]*ipLimiter{"1.1.1.1": {}}}
+	defer func() {
+		maintenance.Store(savedMaintenance)
+		ipLimiters = savedIps
+	}()
+	maintenance.Store(false)
+	rec = reload("MAINTENANCE=true\nIP_LIMIT_BOOST=5")
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || strings.Contains(fmt.Sprint(response.Restart), "MAINTENANCE") {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	if !maintenance.Load() || len(ipLimiters.limiters) != 0 || currentConfig().IpLimitBoost != 5 {
+		t.Fatal(maintenance.Load(), ipLimiters.limiters)
+	}
+
+	//Switched off by the admin, an unrelated reload keeps it off
+	maintenance.Store(false)
+	if reload("HOST_LIMIT=4"); maintenance.Load() {
+		t.Fatal("maintenance back on")
+	}
+}